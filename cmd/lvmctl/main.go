@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	flagKubeconfig = "kubeconfig"
+	flagNamespace  = "namespace"
+	flagNode       = "node"
+	flagApply      = "apply"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Usage = "maintenance tool for csi-driver-lvm"
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    flagKubeconfig,
+			Usage:   "path to the kubeconfig, defaults to the in-cluster config",
+			EnvVars: []string{"KUBECONFIG"},
+		},
+		&cli.StringFlag{
+			Name:  flagNamespace,
+			Usage: "the namespace csi-driver-lvm is installed in",
+			Value: "default",
+		},
+	}
+	app.Commands = []*cli.Command{
+		migrateCmd(),
+		undeleteCmd(),
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func kubeClient(c *cli.Context) (*kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", c.String(flagKubeconfig))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig: %v", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
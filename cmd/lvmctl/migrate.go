@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	flagLegacyProvisioner = "legacy-provisioner"
+	flagDriverName        = "drivername"
+	flagVGName            = "vgname"
+	flagStorageClass      = "storageclass"
+	flagTimeout           = "timeout"
+
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	// legacy csi-lvm volumes are bound to the node by its hostname label
+	legacyNodeKey = "kubernetes.io/hostname"
+	// topologyKeyNode must match the topology key of the lvm plugin
+	topologyKeyNode = "topology.lvm.csi/node"
+	// importAnnotation must match the annotation the lvm plugin imports logical volumes for
+	importAnnotation = "csi-lvm.metal-stack.io/import"
+	// driverTag must match the tag of the logical volumes of the lvm plugin
+	driverTag = "lv.metal-stack.io/csi-lvm-driver"
+)
+
+// bindAnnotations are set by the persistent volume controller when a claim is bound, they must not be copied to the recreated claim
+var bindAnnotations = []string{
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+	"volume.beta.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/selected-node",
+}
+
+// migration is the plan to migrate a single legacy volume
+type migration struct {
+	pv     v1.PersistentVolume
+	pvc    *v1.PersistentVolumeClaim
+	node   string
+	lvName string
+	// tagged is true if the logical volume is already tagged as volume of the driver
+	tagged bool
+	// skip is the reason why the volume can not be migrated
+	skip string
+}
+
+func migrateCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: "migrates hostPath volumes of the legacy csi-lvm provisioner to csi volumes without copying data. Only a report is printed unless --apply is given.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagNode,
+				Usage: "only migrate volumes on this node",
+			},
+			&cli.BoolFlag{
+				Name:  flagApply,
+				Usage: "migrate the volumes, the pods using them must be stopped",
+			},
+			&cli.StringFlag{
+				Name:  flagLegacyProvisioner,
+				Usage: "the provisioner name of the legacy csi-lvm",
+				Value: "metal-stack.io/csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:  flagDriverName,
+				Usage: "the name of the csi driver",
+				Value: "lvm.csi.metal-stack.io",
+			},
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "the name of the volumegroup",
+				Value: "csi-lvm",
+			},
+			&cli.StringFlag{
+				Name:  flagStorageClass,
+				Usage: "storage class of the migrated volumes, defaults to the storage class of the legacy volume",
+			},
+			&cli.DurationFlag{
+				Name:  flagTimeout,
+				Usage: "how long to wait for the deletion of the legacy objects",
+				Value: 2 * time.Minute,
+			},
+		},
+		Action: migrate,
+	}
+}
+
+func migrate(c *cli.Context) error {
+	client, err := kubeClient(c)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := planMigrations(c, client)
+	if err != nil {
+		return err
+	}
+	printReport(migrations)
+
+	if !c.Bool(flagApply) {
+		fmt.Println("\ndry run, use --apply to migrate the volumes")
+		return nil
+	}
+
+	failed := 0
+	for _, m := range migrations {
+		if m.skip != "" {
+			continue
+		}
+		if err := applyMigration(c, client, m); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to migrate volume %s: %v\n", m.pv.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("volume %s migrated\n", m.pv.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d volumes could not be migrated", failed)
+	}
+	return nil
+}
+
+// planMigrations finds the volumes of the legacy provisioner and checks if they can be migrated
+func planMigrations(c *cli.Context, client *kubernetes.Clientset) ([]migration, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list persistent volumes: %v", err)
+	}
+
+	nodeLVs := map[string][]lvm.LogicalVolume{}
+	var migrations []migration
+	for _, pv := range pvs.Items {
+		if pv.Spec.HostPath == nil || pv.Annotations[provisionedByAnnotation] != c.String(flagLegacyProvisioner) {
+			continue
+		}
+		m := migration{
+			pv:     pv,
+			node:   legacyNode(pv),
+			lvName: filepath.Base(pv.Spec.HostPath.Path),
+		}
+		if c.String(flagNode) != "" && m.node != c.String(flagNode) {
+			continue
+		}
+		m.skip = checkMigration(c, client, &m, nodeLVs)
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// checkMigration looks up the logical volume and the claim of a legacy volume, it returns the reason why the volume can not be migrated
+func checkMigration(c *cli.Context, client *kubernetes.Clientset, m *migration, nodeLVs map[string][]lvm.LogicalVolume) string {
+	if m.node == "" {
+		return "no node affinity"
+	}
+
+	lvs, ok := nodeLVs[m.node]
+	if !ok {
+		var err error
+		lvs, err = lvm.NodeLogicalVolumes(*client, c.String(flagNamespace), m.node)
+		if err != nil {
+			return fmt.Sprintf("no lvm inventory of node %s, is csi-driver-lvm running there? %v", m.node, err)
+		}
+		nodeLVs[m.node] = lvs
+	}
+	found := false
+	for _, lv := range lvs {
+		if lv.Name == m.lvName && lv.VGName == c.String(flagVGName) {
+			found = true
+			for _, tag := range lv.Tags {
+				if tag == driverTag {
+					m.tagged = true
+				}
+			}
+			break
+		}
+	}
+	if !found {
+		return fmt.Sprintf("logical volume %s/%s not found on node %s", c.String(flagVGName), m.lvName, m.node)
+	}
+
+	ref := m.pv.Spec.ClaimRef
+	if ref == nil || m.pv.Status.Phase != v1.VolumeBound {
+		return ""
+	}
+	pvc, err := client.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Sprintf("unable to read claim %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	m.pvc = pvc
+
+	pods, err := client.CoreV1().Pods(ref.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Sprintf("unable to list pods of namespace %s: %v", ref.Namespace, err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == ref.Name {
+				return fmt.Sprintf("in use by pod %s/%s", pod.Namespace, pod.Name)
+			}
+		}
+	}
+	return ""
+}
+
+func printReport(migrations []migration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PV\tCLAIM\tNODE\tLV\tSIZE\tACTION")
+	for _, m := range migrations {
+		claim := "-"
+		if m.pvc != nil {
+			claim = m.pvc.Namespace + "/" + m.pvc.Name
+		}
+		action := "migrate"
+		if !m.tagged {
+			action = "migrate, tag lv"
+		}
+		if m.skip != "" {
+			action = "skip: " + m.skip
+		}
+		size := m.pv.Spec.Capacity[v1.ResourceStorage]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", m.pv.Name, claim, m.node, m.lvName, size.String(), action)
+	}
+	w.Flush()
+	if len(migrations) == 0 {
+		fmt.Println("no volumes of the legacy provisioner found")
+		return
+	}
+	fmt.Println("\nuntagged logical volumes are tagged as volumes of csi-driver-lvm by the plugin on their node after the migration")
+}
+
+// applyMigration replaces the legacy persistent volume by a csi volume with the same name and rebinds the claim.
+// The reclaim policy of the legacy volume is set to Retain before, so the logical volume is kept when the objects are deleted.
+func applyMigration(c *cli.Context, client *kubernetes.Clientset, m migration) error {
+	ctx := context.Background()
+	pvs := client.CoreV1().PersistentVolumes()
+
+	reclaimPolicy := m.pv.Spec.PersistentVolumeReclaimPolicy
+	pv, err := pvs.Get(ctx, m.pv.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	_, err = pvs.Update(ctx, pv, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to set reclaim policy to retain: %v", err)
+	}
+
+	if m.pvc != nil {
+		pvcs := client.CoreV1().PersistentVolumeClaims(m.pvc.Namespace)
+		err = pvcs.Delete(ctx, m.pvc.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to delete claim: %v", err)
+		}
+		err = waitDeleted(c.Duration(flagTimeout), func() error {
+			_, err := pvcs.Get(ctx, m.pvc.Name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("claim %s/%s not deleted: %v", m.pvc.Namespace, m.pvc.Name, err)
+		}
+	}
+
+	err = pvs.Delete(ctx, m.pv.Name, metav1.DeleteOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to delete legacy volume: %v", err)
+	}
+	err = waitDeleted(c.Duration(flagTimeout), func() error {
+		_, err := pvs.Get(ctx, m.pv.Name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("legacy volume not deleted: %v", err)
+	}
+
+	_, err = pvs.Create(ctx, csiVolume(c, m, reclaimPolicy), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to create csi volume: %v", err)
+	}
+
+	if m.pvc != nil {
+		_, err = client.CoreV1().PersistentVolumeClaims(m.pvc.Namespace).Create(ctx, rebindClaim(c, m), metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to recreate claim %s/%s: %v", m.pvc.Namespace, m.pvc.Name, err)
+		}
+	}
+	return nil
+}
+
+// csiVolume returns the csi volume which replaces the legacy volume
+func csiVolume(c *cli.Context, m migration, reclaimPolicy v1.PersistentVolumeReclaimPolicy) *v1.PersistentVolume {
+	storageClass := m.pv.Spec.StorageClassName
+	if c.String(flagStorageClass) != "" {
+		storageClass = c.String(flagStorageClass)
+	}
+	volumeMode := v1.PersistentVolumeFilesystem
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   m.pv.Name,
+			Labels: m.pv.Labels,
+			Annotations: map[string]string{
+				provisionedByAnnotation: c.String(flagDriverName),
+				// the plugin tags the logical volume, without the tag it is not listed, trimmed or reported
+				importAnnotation: "true",
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes:                   m.pv.Spec.AccessModes,
+			Capacity:                      m.pv.Spec.Capacity,
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			StorageClassName:              storageClass,
+			MountOptions:                  m.pv.Spec.MountOptions,
+			VolumeMode:                    &volumeMode,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       c.String(flagDriverName),
+					VolumeHandle: strings.Join([]string{m.node, c.String(flagVGName), m.lvName}, "/"),
+				},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      topologyKeyNode,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{m.node},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if m.pvc != nil {
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  m.pvc.Namespace,
+			Name:       m.pvc.Name,
+		}
+	}
+	return pv
+}
+
+// rebindClaim returns the claim to recreate, bound to the csi volume
+func rebindClaim(c *cli.Context, m migration) *v1.PersistentVolumeClaim {
+	annotations := map[string]string{}
+	for k, v := range m.pvc.Annotations {
+		annotations[k] = v
+	}
+	for _, a := range bindAnnotations {
+		delete(annotations, a)
+	}
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        m.pvc.Name,
+			Namespace:   m.pvc.Namespace,
+			Labels:      m.pvc.Labels,
+			Annotations: annotations,
+		},
+		Spec: *m.pvc.Spec.DeepCopy(),
+	}
+	pvc.Spec.VolumeName = m.pv.Name
+	if c.String(flagStorageClass) != "" {
+		storageClass := c.String(flagStorageClass)
+		pvc.Spec.StorageClassName = &storageClass
+	}
+	return pvc
+}
+
+func legacyNode(pv v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == legacyNodeKey && len(expr.Values) > 0 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// waitDeleted polls get until the object is not found
+func waitDeleted(timeout time.Duration, get func() error) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		err := get()
+		if k8serror.IsNotFound(err) {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("timeout after %s", timeout)
+}
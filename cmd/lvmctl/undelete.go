@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	flagVolume = "volume"
+	flagClaim  = "claim"
+
+	// undeleteAnnotation must match the annotation the lvm plugin restores trashed volumes for
+	undeleteAnnotation = "csi-lvm.metal-stack.io/undelete"
+)
+
+func undeleteCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "undelete",
+		Usage: "recreates the persistent volume of a deleted volume which is still in the trash of its node. Without --volume the trash of the node is listed.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     flagNode,
+				Usage:    "the node of the deleted volume",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  flagVolume,
+				Usage: "the name of the deleted persistent volume",
+			},
+			&cli.StringFlag{
+				Name:  flagStorageClass,
+				Usage: "storage class of the recreated persistent volume",
+			},
+			&cli.StringFlag{
+				Name:  flagClaim,
+				Usage: "namespace/name of the claim the recreated persistent volume is reserved for",
+			},
+			&cli.StringFlag{
+				Name:  flagDriverName,
+				Usage: "the name of the csi driver",
+				Value: "lvm.csi.metal-stack.io",
+			},
+		},
+		Action: undelete,
+	}
+}
+
+func undelete(c *cli.Context) error {
+	client, err := kubeClient(c)
+	if err != nil {
+		return err
+	}
+	node := c.String(flagNode)
+	trashed, err := lvm.NodeTrashedVolumes(*client, c.String(flagNamespace), node)
+	if err != nil {
+		return fmt.Errorf("no lvm inventory of node %s, is csi-driver-lvm running there? %v", node, err)
+	}
+
+	name := c.String(flagVolume)
+	if name == "" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VOLUME\tVG\tSIZE\tDELETED")
+		for _, t := range trashed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, t.LV.VGName, resource.NewQuantity(t.LV.Size, resource.BinarySI), t.DeletedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+
+	var volume *lvm.TrashedVolume
+	for i := range trashed {
+		if trashed[i].Name == name {
+			volume = &trashed[i]
+		}
+	}
+	if volume == nil {
+		return fmt.Errorf("volume %s not found in the trash of node %s", name, node)
+	}
+	if c.String(flagStorageClass) == "" {
+		return fmt.Errorf("--%s is required to recreate volume %s", flagStorageClass, name)
+	}
+
+	pv := trashedVolume(c, node, *volume)
+	if claim := c.String(flagClaim); claim != "" {
+		parts := strings.SplitN(claim, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid claim %s, must be namespace/name", claim)
+		}
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  parts[0],
+			Name:       parts[1],
+		}
+	}
+	_, err = client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to create persistent volume %s: %v", name, err)
+	}
+	fmt.Printf("persistent volume %s created, the volume is restored by the plugin on node %s\n", name, node)
+	return nil
+}
+
+// trashedVolume returns the persistent volume for a trashed volume, it is retained to protect the restored data
+func trashedVolume(c *cli.Context, node string, t lvm.TrashedVolume) *v1.PersistentVolume {
+	volumeMode := v1.PersistentVolumeFilesystem
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: t.Name,
+			Annotations: map[string]string{
+				provisionedByAnnotation: c.String(flagDriverName),
+				undeleteAnnotation:      "true",
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(t.LV.Size, resource.BinarySI),
+			},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			StorageClassName:              c.String(flagStorageClass),
+			VolumeMode:                    &volumeMode,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       c.String(flagDriverName),
+					VolumeHandle: strings.Join([]string{node, t.LV.VGName, t.Name}, "/"),
+				},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      topologyKeyNode,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{node},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
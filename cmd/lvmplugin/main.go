@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -31,22 +32,14 @@ func init() {
 	if err != nil {
 		log.Printf("unable to configure logging to stdout:%v\n", err)
 	}
+	lvm.BindFlags(flag.CommandLine, &config)
 }
 
 var (
-	endpoint                    = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName                  = flag.String("drivername", "lvm.csi.k8s.io", "name of the driver")
-	nodeID                      = flag.String("nodeid", "", "node id")
-	ephemeral                   = flag.Bool("ephemeral", false, "publish volumes in ephemeral mode even if kubelet did not ask for it (only needed for Kubernetes 1.15)")
-	showVersion                 = flag.Bool("version", false, "Show version.")
-	devicesPattern              = flag.String("devices", "", "comma-separated grok patterns of the physical volumes to use.")
-	vgName                      = flag.String("vgname", "csi-lvm", "name of volume group")
-	namespace                   = flag.String("namespace", "csi-lvm", "name of namespace")
-	provisionerImage            = flag.String("provisionerimage", "metalstack/csi-lvmplugin-provisioner", "name of provisioner image")
-	pullPolicy                  = flag.String("pullpolicy", "ifnotpresent", "pull policy for provisioner image")
-	lvmTimeout                  = flag.Int("lvm-timeout", 60, "timeout for lvm provisioner operations (lvcreate/lvremove)")
-	snapshotTimeout             = flag.Int("snapshot-timeout", 3600, "timeout for snapshot provisioner operations (snapshot create/restore")
-	lvmSnapshotBufferPercentage = flag.Int("lvm-snapshot-buffer-percentage", 10, "amount (in percent) for lvm snapshots during snapshot creation")
+	// config holds the defaults and the flags, which override the configuration file
+	config      = lvm.DefaultConfig()
+	configFile  = flag.String("config", "", "yaml file with the configuration, flags override its options, settings such as timeouts and log level are reloaded on change")
+	showVersion = flag.Bool("version", false, "Show version.")
 
 	// Set by the build process
 	version = ""
@@ -61,7 +54,7 @@ func main() {
 		return
 	}
 
-	if *ephemeral {
+	if config.Ephemeral {
 		fmt.Fprintln(os.Stderr, "Deprecation warning: The ephemeral flag is deprecated and should only be used when deploying on Kubernetes 1.15. It will be removed in the future.")
 	}
 
@@ -70,10 +63,26 @@ func main() {
 }
 
 func handle() {
-	driver, err := lvm.NewLvmDriver(*driverName, *nodeID, *endpoint, *ephemeral, version, *devicesPattern, *vgName, *namespace, *provisionerImage, *pullPolicy, *lvmTimeout, *snapshotTimeout, *lvmSnapshotBufferPercentage)
+	config, err := lvm.LoadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %s", err.Error())
+		os.Exit(1)
+	}
+
+	stopTracing, err := lvm.StartTracing(context.Background(), config.OTLPEndpoint, "csi-lvmplugin")
+	if err != nil {
+		fmt.Printf("Failed to start tracing: %s", err.Error())
+		os.Exit(1)
+	}
+	defer stopTracing()
+
+	driver, err := lvm.NewLvmDriver(config, version)
 	if err != nil {
 		fmt.Printf("Failed to initialize driver: %s", err.Error())
 		os.Exit(1)
 	}
+	if *configFile != "" {
+		go driver.WatchConfig(*configFile, flag.CommandLine)
+	}
 	driver.Run()
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	lvm "github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+func cloneLVCmd() *cli.Command {
+	return &cli.Command{
+		Name: "clonelv",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagLVName,
+				Usage: "Required. Specify lv name.",
+			},
+			&cli.StringFlag{
+				Name:  flagSourceLVName,
+				Usage: "Required. Specify the name of the lv to clone.",
+			},
+			&cli.Uint64Flag{
+				Name:  flagLVSize,
+				Usage: "Required. The size of the lv in MiB",
+			},
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+			},
+			&cli.StringFlag{
+				Name:  flagLVMType,
+				Usage: "Required. type of lvs, can be either striped or mirrored",
+			},
+			&cli.StringFlag{
+				Name:  flagWipePolicy,
+				Usage: "Optional. How to wipe the lv before removal: none, discard or zero.",
+			},
+			&cli.StringFlag{
+				Name:  flagPVC,
+				Usage: "Optional. namespace/name of the persistent volume claim, stored as tag.",
+			},
+			&cli.IntFlag{
+				Name:  flagLvmSnapshotBufferPercentage,
+				Usage: "Required. Amount (in percent) to use for lvm snapshots during the copy.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := cloneLV(c); err != nil {
+				fatal(c, "Error cloning lv", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func cloneLV(c *cli.Context) error {
+	lvName := c.String(flagLVName)
+	if lvName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagLVName)
+	}
+	sourceLVName := c.String(flagSourceLVName)
+	if sourceLVName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagSourceLVName)
+	}
+	lvSize := c.Uint64(flagLVSize)
+	if lvSize == 0 {
+		return fmt.Errorf("invalid empty flag %v", flagLVSize)
+	}
+	vgName := c.String(flagVGName)
+	if vgName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagVGName)
+	}
+	lvmType := c.String(flagLVMType)
+	if lvmType == "" {
+		return fmt.Errorf("invalid empty flag %v", flagLVMType)
+	}
+	wipePolicy := c.String(flagWipePolicy)
+	if err := lvm.ValidateWipePolicy(wipePolicy); err != nil {
+		return err
+	}
+	lvmSnapshotBufferPercentage := c.Int(flagLvmSnapshotBufferPercentage)
+	if lvmSnapshotBufferPercentage == 0 {
+		return fmt.Errorf("invalid empty flag %v", flagLvmSnapshotBufferPercentage)
+	}
+
+	klog.Infof("clone lv %s to %s size:%d vg:%s type:%s", sourceLVName, lvName, lvSize, vgName, lvmType)
+
+	err := lvm.ReclaimTrash(vgName, int64(lvSize), lvmType)
+	if err != nil {
+		return lvm.NewProvisionerError(codes.ResourceExhausted, "", "unable to reclaim space of trashed lvs: %v", err)
+	}
+
+	output, err := lvm.CloneLVS(c.Context, vgName, sourceLVName, lvName, lvSize, lvmType, lvmSnapshotBufferPercentage, append(lvm.WipeTags(wipePolicy), lvm.ClaimTags(c.String(flagPVC))...)...)
+	if errors.Is(err, lvm.ErrVolumeMerging) {
+		// the source is rolled back, the clone is retried on this node
+		return lvm.NewProvisionerError(codes.Aborted, output, "unable to clone lv: %v", err)
+	}
+	if err != nil {
+		return lvm.NewProvisionerError(codes.ResourceExhausted, output, "unable to clone lv: %v", err)
+	}
+	return nil
+}
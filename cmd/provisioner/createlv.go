@@ -1,11 +1,11 @@
 package main
 
 import (
-	"context"
 	"fmt"
 
 	lvm "github.com/metal-stack/csi-driver-lvm/pkg/lvm"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
 )
 
@@ -29,6 +29,14 @@ func createLVCmd() *cli.Command {
 				Name:  flagLVMType,
 				Usage: "Required. type of lvs, can be either striped or mirrored",
 			},
+			&cli.StringFlag{
+				Name:  flagWipePolicy,
+				Usage: "Optional. How to wipe the lv before removal: none, discard or zero.",
+			},
+			&cli.StringFlag{
+				Name:  flagPVC,
+				Usage: "Optional. namespace/name of the persistent volume claim, stored as tag.",
+			},
 			&cli.StringFlag{
 				Name:  flagDevicesPattern,
 				Usage: "Required. comma-separated grok patterns of the physical volumes to use.",
@@ -36,7 +44,7 @@ func createLVCmd() *cli.Command {
 		},
 		Action: func(c *cli.Context) error {
 			if err := createLV(c); err != nil {
-				klog.Fatalf("Error creating lv: %v", err)
+				fatal(c, "Error creating lv", err)
 				return err
 			}
 			return nil
@@ -61,6 +69,10 @@ func createLV(c *cli.Context) error {
 	if lvmType == "" {
 		return fmt.Errorf("invalid empty flag %v", flagLVMType)
 	}
+	wipePolicy := c.String(flagWipePolicy)
+	if err := lvm.ValidateWipePolicy(wipePolicy); err != nil {
+		return err
+	}
 	devicesPattern := c.String(flagDevicesPattern)
 	if devicesPattern == "" {
 		return fmt.Errorf("invalid empty flag %v", flagDevicesPattern)
@@ -68,14 +80,19 @@ func createLV(c *cli.Context) error {
 
 	klog.Infof("create lv %s size:%d vg:%s devicespattern:%s  type:%s", lvName, lvSize, vgName, devicesPattern, lvmType)
 
-	output, err := lvm.CreateVG(vgName, devicesPattern)
+	output, err := lvm.CreateVG(c.Context, vgName, devicesPattern)
+	if err != nil {
+		return lvm.NewProvisionerError(codes.ResourceExhausted, output, "unable to create vg: %v", err)
+	}
+
+	err = lvm.ReclaimTrash(vgName, int64(lvSize), lvmType)
 	if err != nil {
-		return fmt.Errorf("unable to create vg: %v output:%s", err, output)
+		return lvm.NewProvisionerError(codes.ResourceExhausted, "", "unable to reclaim space of trashed lvs: %v", err)
 	}
 
-	output, err = lvm.CreateLVS(context.Background(), vgName, lvName, lvSize, lvmType)
+	output, err = lvm.CreateLVS(c.Context, vgName, lvName, lvSize, lvmType, append(lvm.WipeTags(wipePolicy), lvm.ClaimTags(c.String(flagPVC))...)...)
 	if err != nil {
-		return fmt.Errorf("unable to create lv: %v output:%s", err, output)
+		return lvm.NewProvisionerError(codes.ResourceExhausted, output, "unable to create lv: %v", err)
 	}
 	return nil
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 
 	lvm "github.com/metal-stack/csi-driver-lvm/pkg/lvm"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
 )
 
@@ -36,11 +38,15 @@ func createSnapshotCmd() *cli.Command {
 				Name:  flagLvmSnapshotBufferPercentage,
 				Usage: "Required. Amount (in percent) to use for lvm snapshots during creation.",
 			},
-
+			&cli.StringFlag{
+				Name:  flagBackend,
+				Value: "s3",
+				Usage: "Optional. Where to keep the snapshot, either s3 or local.",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			if err := createSnapshot(c); err != nil {
-				klog.Fatalf("Error creating snapshot: %v", err)
+				fatal(c, "Error creating snapshot", err)
 				return err
 			}
 			return nil
@@ -57,14 +63,32 @@ func createSnapshot(c *cli.Context) error {
 	if vgName == "" {
 		return fmt.Errorf("invalid empty flag %v", flagVGName)
 	}
-	lvSize := c.Uint64(flagLVSize)
-	if lvSize == 0 {
-		return fmt.Errorf("invalid empty flag %v", flagLVSize)
-	}
 	snapshotName := c.String(flagSnapshotName)
 	if snapshotName == "" {
 		return fmt.Errorf("invalid empty flag %v", flagSnapshotName)
 	}
+	lvmSnapshotBufferPercentage := c.Int(flagLvmSnapshotBufferPercentage)
+	if lvmSnapshotBufferPercentage == 0 {
+		return fmt.Errorf("invalid empty flag %v", flagLvmSnapshotBufferPercentage)
+	}
+
+	if c.String(flagBackend) == "local" {
+		klog.Infof("create local snapshot %s from %s", snapshotName, lvName)
+
+		output, err := lvm.CreateLocalSnapshot(c.Context, vgName, lvName, snapshotName, lvmSnapshotBufferPercentage)
+		if errors.Is(err, lvm.ErrVolumeMerging) {
+			return lvm.NewProvisionerError(codes.Aborted, output, "unable to create snapshot: %v", err)
+		}
+		if err != nil {
+			return lvm.NewProvisionerError(lvm.LVMErrorCode(output), output, "unable to create snapshot: %v", err)
+		}
+		return nil
+	}
+
+	lvSize := c.Uint64(flagLVSize)
+	if lvSize == 0 {
+		return fmt.Errorf("invalid empty flag %v", flagLVSize)
+	}
 	s3parameterString := c.String(flagS3Parameter)
 	if s3parameterString == "" {
 		return fmt.Errorf("invalid empty flag %v", flagS3Parameter)
@@ -73,18 +97,21 @@ func createSnapshot(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("unable to decode %s", flagS3Parameter)
 	}
-	lvmSnapshotBufferPercentage := c.Int(flagLvmSnapshotBufferPercentage)
-	if lvSize == 0 {
-		return fmt.Errorf("invalid empty flag %v", flagLvmSnapshotBufferPercentage)
-	}
 
 	// create lvm snapshot
 
 	klog.Infof("create snapshot %s from %s", snapshotName, lvName)
 
-	output, err := lvm.CreateS3Snapshot(vgName, lvName, snapshotName, lvSize, s3parameter, lvmSnapshotBufferPercentage)
+	output, stats, err := lvm.CreateS3Snapshot(c.Context, vgName, lvName, snapshotName, lvSize, s3parameter, lvmSnapshotBufferPercentage)
+	if errors.Is(err, lvm.ErrVolumeMerging) {
+		return lvm.NewProvisionerError(codes.Aborted, output, "unable to create snapshot: %v", err)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to create snapshot: %v output:%s", err, output)
+		return lvm.NewProvisionerError(codes.Unavailable, output, "unable to create snapshot: %v", err)
+	}
+	// the controller exposes the backup stats as metrics
+	if err := lvm.WriteTerminationResult(c.String(flagTerminationLog), &lvm.ProvisionerResult{Backup: stats}); err != nil {
+		klog.Errorf("unable to write termination log: %v", err)
 	}
 
 	return nil
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
 )
 
@@ -21,10 +24,19 @@ func deleteLVCmd() *cli.Command {
 				Name:  flagVGName,
 				Usage: "Required. the name of the volumegroup",
 			},
+			&cli.DurationFlag{
+				Name:  flagTrashRetention,
+				Usage: "Optional. Move the lv to the trash for this duration instead of removing it.",
+			},
+			&cli.DurationFlag{
+				Name:  flagWipeTimeout,
+				Usage: "Optional. Timeout for wiping the lv according to its wipe policy.",
+				Value: time.Hour,
+			},
 		},
 		Action: func(c *cli.Context) error {
 			if err := deleteLV(c); err != nil {
-				klog.Fatalf("Error deleting lv: %v", err)
+				fatal(c, "Error deleting lv", err)
 				return err
 			}
 			return nil
@@ -42,11 +54,22 @@ func deleteLV(c *cli.Context) error {
 		return fmt.Errorf("invalid empty flag %v", flagVGName)
 	}
 
-	klog.Infof("delete lv %s vg:%s ", lvName, vgName)
+	trashRetention := c.Duration(flagTrashRetention)
+
+	klog.Infof("delete lv %s vg:%s trashretention:%s", lvName, vgName, trashRetention)
 
-	output, err := lvm.RemoveLVS(context.Background(), vgName, lvName)
+	ctx, cancel := context.WithTimeout(c.Context, c.Duration(flagWipeTimeout))
+	defer cancel()
+	output, err := lvm.DeleteLV(ctx, vgName, lvName, trashRetention)
+	if errors.Is(err, lvm.ErrVolumeMerging) {
+		return lvm.NewProvisionerError(codes.Aborted, output, "unable to delete lv: %v", err)
+	}
+	if errors.Is(err, lvm.ErrVolumeHasSnapshots) {
+		// the volume is deleted by a retry of the controller once its snapshots are gone
+		return lvm.NewProvisionerError(codes.FailedPrecondition, output, "unable to delete lv: %v", err)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to delete lv: %v output:%s", err, output)
+		return lvm.NewProvisionerError(lvm.LVMErrorCode(output), output, "unable to delete lv: %v", err)
 	}
 	klog.Infof("lv %s vg:%s deleted", lvName, vgName)
 	return nil
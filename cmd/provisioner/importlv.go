@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// topologyKeyNode must match the topology key of the lvm plugin
+const topologyKeyNode = "topology.lvm.csi/node"
+
+func importLVCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "importlv",
+		Usage: "validates an existing lv, tags it for the driver and prints a persistent volume for it",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagLVName,
+				Usage: "Required. Specify lv name.",
+			},
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+			},
+			&cli.StringFlag{
+				Name:    flagNodeName,
+				Usage:   "Required. the name of the node the lv is located on",
+				EnvVars: []string{"NODE_NAME"},
+			},
+			&cli.StringFlag{
+				Name:  flagPVName,
+				Usage: "the name of the persistent volume, defaults to the lv name",
+			},
+			&cli.StringFlag{
+				Name:  flagStorageClass,
+				Usage: "the storage class of the persistent volume",
+				Value: "csi-driver-lvm-linear",
+			},
+			&cli.StringFlag{
+				Name:  flagDriverName,
+				Usage: "the name of the csi driver",
+				Value: "lvm.csi.metal-stack.io",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := importLV(c); err != nil {
+				fatal(c, "Error importing lv", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func importLV(c *cli.Context) error {
+	lvName := c.String(flagLVName)
+	if lvName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagLVName)
+	}
+	vgName := c.String(flagVGName)
+	if vgName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagVGName)
+	}
+	nodeName := c.String(flagNodeName)
+	if nodeName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagNodeName)
+	}
+	pvName := c.String(flagPVName)
+	if pvName == "" {
+		pvName = strings.ToLower(strings.ReplaceAll(lvName, "_", "-"))
+	}
+
+	klog.Infof("import lv %s vg:%s node:%s", lvName, vgName, nodeName)
+
+	lv, fsType, err := lvm.ImportLV(c.Context, vgName, lvName)
+	if err != nil {
+		return fmt.Errorf("unable to import lv: %v", err)
+	}
+
+	volumeMode := v1.PersistentVolumeFilesystem
+	if fsType == "" {
+		klog.Infof("no filesystem found on lv %s, importing it as block volume", lvName)
+		volumeMode = v1.PersistentVolumeBlock
+	}
+
+	pv := v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pvName,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(lv.Size, resource.BinarySI),
+			},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			StorageClassName:              c.String(flagStorageClass),
+			VolumeMode:                    &volumeMode,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       c.String(flagDriverName),
+					VolumeHandle: strings.Join([]string{nodeName, vgName, lvName}, "/"),
+					FSType:       fsType,
+				},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      topologyKeyNode,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{nodeName},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	out, err := yaml.Marshal(pv)
+	if err != nil {
+		return fmt.Errorf("unable to render persistent volume: %v", err)
+	}
+	fmt.Fprintf(os.Stdout, "%s", out)
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
 	"github.com/urfave/cli/v2"
 	"k8s.io/klog/v2"
 )
@@ -18,6 +20,17 @@ const (
 	flagSnapshotName   = "snapshotname"
 	flagS3Parameter    = "s3parameter"
 	flagLvmSnapshotBufferPercentage = "lvmsnapshotbufferpercentage"
+	flagSourceLVName   = "sourcelvname"
+	flagBackend        = "backend"
+	flagNodeName       = "nodename"
+	flagPVName         = "pvname"
+	flagStorageClass   = "storageclass"
+	flagDriverName     = "drivername"
+	flagTrashRetention = "trashretention"
+	flagWipePolicy     = "wipepolicy"
+	flagWipeTimeout    = "wipetimeout"
+	flagTerminationLog = "terminationlog"
+	flagPVC            = "pvc"
 )
 
 func cmdNotFound(c *cli.Context, command string) {
@@ -28,21 +41,61 @@ func onUsageError(c *cli.Context, err error, isSubcommand bool) error {
 	panic(fmt.Errorf("usage error, please check your command"))
 }
 
+// endSpan ends the span of the command and flushes it
+var endSpan = func(error) {}
+
+// fatal writes the error to the termination log, which is read by the controller, and exits
+func fatal(c *cli.Context, msg string, err error) {
+	endSpan(err)
+	if werr := lvm.WriteTerminationMessage(c.String(flagTerminationLog), err); werr != nil {
+		klog.Errorf("unable to write termination log: %v", werr)
+	}
+	klog.Fatalf("%s: %v", msg, err)
+}
+
 func main() {
 	p := cli.NewApp()
 	p.Usage = "LVM Provisioner Pod"
+	p.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  flagTerminationLog,
+			Value: lvm.TerminationLogPath,
+			Usage: "Optional. file the error is written to if the command fails.",
+		},
+	}
 	p.Commands = []*cli.Command{
 		createLVCmd(),
 		deleteLVCmd(),
 		createSnapshotCmd(),
 		restoreSnapshotCmd(),
+		cloneLVCmd(),
+		rollbackLVCmd(),
+		importLVCmd(),
 	}
+	p.Before = acquireNodeSlot
 	p.CommandNotFound = cmdNotFound
 	p.OnUsageError = onUsageError
 
 	klog.Infof("starting csi-lvmplugin-provisioner")
 
-	if err := p.Run(os.Args); err != nil {
+	ctx, end := lvm.StartProvisionerSpan(context.Background(), commandName(p.Commands, os.Args[1:]))
+	endSpan = end
+	err := p.RunContext(ctx, os.Args)
+	releaseNodeSlot()
+	endSpan(err)
+	if err != nil {
 		klog.Errorf("Critical error: %v", err)
 	}
 }
+
+// commandName returns the name of the command in args
+func commandName(commands []*cli.Command, args []string) string {
+	for _, arg := range args {
+		for _, cmd := range commands {
+			if arg == cmd.Name {
+				return arg
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+)
+
+// releaseNodeSlot keeps the slot file open, the finalizer of the file would release the slot otherwise
+var releaseNodeSlot = func() {}
+
+// acquireNodeSlot waits for a free slot of the node before the command runs, the slot is released when the
+// provisioner exits
+func acquireNodeSlot(c *cli.Context) error {
+	max, _ := strconv.Atoi(os.Getenv(lvm.MaxNodeOperationsEnv))
+	release, err := lvm.AcquireNodeSlot(c.Context, max)
+	if err != nil {
+		err = lvm.NewProvisionerError(codes.Unavailable, "", "unable to wait for other lvm operations on this node: %v", err)
+		fatal(c, "Error waiting for a node slot", err)
+		return err
+	}
+	releaseNodeSlot = release
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 
 	lvm "github.com/metal-stack/csi-driver-lvm/pkg/lvm"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
 )
 
@@ -31,7 +32,7 @@ func restoreSnapshotCmd() *cli.Command {
 		},
 		Action: func(c *cli.Context) error {
 			if err := restoreSnapshot(c); err != nil {
-				klog.Fatalf("Error creating snapshot: %v", err)
+				fatal(c, "Error creating snapshot", err)
 				return err
 			}
 			return nil
@@ -63,9 +64,9 @@ func restoreSnapshot(c *cli.Context) error {
 
 	klog.Infof("restore %s from snapshot %s", lvName, snapshotName)
 
-	output, err := lvm.RestoreS3Snapshot(vgName, lvName, snapshotName, s3parameter)
+	output, err := lvm.RestoreS3Snapshot(c.Context, vgName, lvName, snapshotName, s3parameter)
 	if err != nil {
-		return fmt.Errorf("unable to create snapshot: %v output:%s", err, output)
+		return lvm.NewProvisionerError(codes.Unavailable, output, "unable to create snapshot: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/metal-stack/csi-driver-lvm/pkg/lvm"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+func rollbackLVCmd() *cli.Command {
+	return &cli.Command{
+		Name: "rollbacklv",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  flagLVName,
+				Usage: "Required. Specify lv name.",
+			},
+			&cli.StringFlag{
+				Name:  flagSnapshotName,
+				Usage: "Required. the name of the local snapshot lv to roll back to",
+			},
+			&cli.StringFlag{
+				Name:  flagVGName,
+				Usage: "Required. the name of the volumegroup",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if err := rollbackLV(c); err != nil {
+				fatal(c, "Error rolling back lv", err)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+func rollbackLV(c *cli.Context) error {
+	lvName := c.String(flagLVName)
+	if lvName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagLVName)
+	}
+	snapshotName := c.String(flagSnapshotName)
+	if snapshotName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagSnapshotName)
+	}
+	vgName := c.String(flagVGName)
+	if vgName == "" {
+		return fmt.Errorf("invalid empty flag %v", flagVGName)
+	}
+
+	klog.Infof("rollback lv %s to snapshot %s vg:%s", lvName, snapshotName, vgName)
+
+	output, err := lvm.MergeLocalSnapshot(c.Context, vgName, lvName, snapshotName)
+	if errors.Is(err, lvm.ErrVolumeInUse) {
+		// the controller defers the rollback until the volume is unpublished
+		return lvm.NewProvisionerError(codes.FailedPrecondition, output, "unable to roll back lv: %v", err)
+	}
+	if err != nil {
+		return lvm.NewProvisionerError(lvm.LVMErrorCode(output), output, "unable to roll back lv: %v", err)
+	}
+	klog.Infof("lv %s rolled back to snapshot %s vg:%s", lvName, snapshotName, vgName)
+	return nil
+}
@@ -0,0 +1,350 @@
+package lvm
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// The agent runs in the node plugin and executes the provisioner commands locally, the controller calls it instead
+// of starting a provisioner job. The messages are encoded as json, there is no protobuf definition.
+const (
+	agentServiceName = "csi-lvm.metal-stack.io.Agent"
+	agentRunMethod   = "/" + agentServiceName + "/Run"
+	agentCodec       = "json"
+	agentTokenHeader = "authorization"
+	provisionerPath  = "/csi-lvmplugin-provisioner"
+	// agentServerName is the name in the agent certificate, agents are dialed by pod ip
+	agentServerName = "csi-driver-lvm-agent"
+
+	// agentDialTimeout is the time to connect to an agent before falling back to a provisioner job
+	agentDialTimeout = 5 * time.Second
+)
+
+// agentRequest is a volume action executed by the agent
+type agentRequest struct {
+	Action                      actionType    `json:"action"`
+	Name                        string        `json:"name"`
+	VGName                      string        `json:"vgname"`
+	Size                        int64         `json:"size,omitempty"`
+	LVMType                     string        `json:"lvmtype,omitempty"`
+	SnapshotName                string        `json:"snapshotname,omitempty"`
+	SourceName                  string        `json:"sourcename,omitempty"`
+	Backend                     string        `json:"backend,omitempty"`
+	S3Parameter                 S3Parameter   `json:"s3parameter"`
+	LvmSnapshotBufferPercentage int           `json:"lvmsnapshotbufferpercentage,omitempty"`
+	TrashRetention              time.Duration `json:"trashretention,omitempty"`
+	WipePolicy                  string        `json:"wipepolicy,omitempty"`
+	WipeTimeout                 int           `json:"wipetimeout,omitempty"`
+	// PVC is <namespace>/<name> of the claim of the volume
+	PVC string `json:"pvc,omitempty"`
+	// Timeout in seconds
+	Timeout int `json:"timeout"`
+}
+
+type agentResponse struct {
+	Output string             `json:"output"`
+	Result *ProvisionerResult `json:"result,omitempty"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return agentCodec }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+func newAgentRequest(va volumeAction, timeout int) *agentRequest {
+	return &agentRequest{
+		Action:                      va.action,
+		Name:                        va.name,
+		VGName:                      va.vgName,
+		Size:                        va.size,
+		LVMType:                     va.lvmType,
+		SnapshotName:                va.snapshotName,
+		SourceName:                  va.sourceName,
+		Backend:                     va.backend,
+		S3Parameter:                 va.S3Parameter,
+		LvmSnapshotBufferPercentage: va.lvmSnapshotBufferPercentage,
+		TrashRetention:              va.trashRetention,
+		WipePolicy:                  va.wipePolicy,
+		WipeTimeout:                 va.wipeTimeout,
+		PVC:                         claimName(va.pvc),
+		Timeout:                     timeout,
+	}
+}
+
+// agentServer executes volume actions on this node
+type agentServer struct {
+	nodeID         string
+	vgName         string
+	devicesPattern string
+	token          string
+}
+
+func (a *agentServer) run(ctx context.Context, req *agentRequest) (*agentResponse, error) {
+	// the agent only manages the volume group and devices of its node plugin
+	if req.VGName != a.vgName {
+		return nil, status.Errorf(codes.InvalidArgument, "volume group %s is not managed by the agent on node %s", req.VGName, a.nodeID)
+	}
+	va := volumeAction{
+		action:                      req.Action,
+		name:                        req.Name,
+		nodeName:                    a.nodeID,
+		size:                        req.Size,
+		lvmType:                     req.LVMType,
+		devicesPattern:              a.devicesPattern,
+		vgName:                      req.VGName,
+		snapshotName:                req.SnapshotName,
+		sourceName:                  req.SourceName,
+		backend:                     req.Backend,
+		S3Parameter:                 req.S3Parameter,
+		lvmSnapshotBufferPercentage: req.LvmSnapshotBufferPercentage,
+		trashRetention:              req.TrashRetention,
+		wipePolicy:                  req.WipePolicy,
+		wipeTimeout:                 req.WipeTimeout,
+	}
+	if parts := strings.SplitN(req.PVC, "/", 2); len(parts) == 2 {
+		va.pvc = &v1.ObjectReference{Namespace: parts[0], Name: parts[1]}
+	}
+	args, err := provisionerArgs(va)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(args) == 0 || args[0] == "--lvname" {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown action %s", req.Action)
+	}
+
+	terminationLog, err := ioutil.TempFile("", "csi-lvm-agent-")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to create termination log: %v", err)
+	}
+	terminationLog.Close()
+	defer os.Remove(terminationLog.Name())
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+	defer cancel()
+	klog.Infof("agent: %s %s for volume %s", provisionerPath, args[0], req.Name)
+	args = append([]string{"--terminationlog", terminationLog.Name()}, args...)
+	cmd := exec.CommandContext(ctx, provisionerPath, args...)
+	cmd.Env = os.Environ()
+	for _, env := range traceEnv(ctx) {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", MaxNodeOperationsEnv, maxNodeOperations))
+	out, err := runCommand(ctx, cmd)
+	if err != nil {
+		klog.Errorf("agent: %s of volume %s failed: %v output:%s", req.Action, req.Name, err, out)
+		if ctx.Err() != nil {
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s of volume %s timeout after %d seconds", req.Action, req.Name, req.Timeout)
+		}
+		if message, _ := ioutil.ReadFile(terminationLog.Name()); len(message) > 0 {
+			if pe := readTerminationMessage(string(message)); pe != nil {
+				return nil, pe.GRPCStatus().Err()
+			}
+		}
+		// the same code as a failed provisioner job, the volume may be rescheduled to another node
+		return nil, status.Errorf(codes.ResourceExhausted, "%s of volume %s failed: %v output:%s", req.Action, req.Name, err, out)
+	}
+	klog.Infof("agent: %s for volume %s was successful", req.Action, req.Name)
+	resp := &agentResponse{Output: string(out)}
+	if message, _ := ioutil.ReadFile(terminationLog.Name()); len(message) > 0 {
+		resp.Result = readTerminationResult(string(message))
+	}
+	return resp, nil
+}
+
+// authenticate rejects requests without the shared agent token
+func (a *agentServer) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(agentTokenHeader)
+	if len(values) != 1 || subtle.ConstantTimeCompare([]byte(values[0]), []byte("Bearer "+a.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid agent token")
+	}
+	return handler(ctx, req)
+}
+
+var agentServiceDesc = grpc.ServiceDesc{
+	ServiceName: agentServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Run",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &agentRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				a := srv.(*agentServer)
+				if interceptor == nil {
+					return a.run(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: agentRunMethod}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return a.run(ctx, req.(*agentRequest))
+				})
+			},
+		},
+	},
+}
+
+// agentTLSConfig holds the certificates of agents and controller, both present a certificate of the shared ca
+type agentTLSConfig struct {
+	server *tls.Config
+	client *tls.Config
+}
+
+// loadAgentTLS reads ca.crt, tls.crt and tls.key from dir
+func loadAgentTLS(dir string) (*agentTLSConfig, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load agent certificate: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read agent ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in agent ca %s", filepath.Join(dir, "ca.crt"))
+	}
+	return &agentTLSConfig{
+		server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+		client: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ServerName:   agentServerName,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// serveAgent serves the agent on address, clients must present a certificate of the agent ca and requests must carry
+// the token
+func serveAgent(address string, nodeID string, vgName string, devicesPattern string, token string, tlsConfig *tls.Config) {
+	a := &agentServer{nodeID: nodeID, vgName: vgName, devicesPattern: devicesPattern, token: token}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		klog.Errorf("unable to listen for agent requests on %s: %v", address, err)
+		return
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), a.authenticate))
+	server.RegisterService(&agentServiceDesc, a)
+	klog.Infof("serving agent on %s", address)
+	if err := server.Serve(listener); err != nil {
+		klog.Errorf("unable to serve agent: %v", err)
+	}
+}
+
+// callAgent executes the volume action with the agent at address
+func callAgent(ctx context.Context, address string, token string, tlsConfig *tls.Config, va volumeAction, timeout int) error {
+	dialCtx, cancel := context.WithTimeout(ctx, agentDialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), grpc.WithBlock(), grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx, err)
+		}
+		return status.Errorf(codes.Unavailable, "unable to connect to agent %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	// the agent enforces the timeout, some slack for the transport
+	ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second+agentDialTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, agentTokenHeader, "Bearer "+token)
+	resp := &agentResponse{}
+	err = conn.Invoke(ctx, agentRunMethod, newAgentRequest(va, timeout), resp, grpc.CallContentSubtype(agentCodec))
+	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx, err)
+		}
+		return err
+	}
+	klog.V(4).Infof("agent %s output of %s: %s", address, va.action, strings.TrimSpace(resp.Output))
+	recordProvisionerResult(va, resp.Result)
+	return nil
+}
+
+// runVolumeAction executes the volume action with the agent of the node if enabled, the provisioner job is used if the
+// agent is disabled or can not be reached and for actions with s3 credentials, which are never sent to an agent. The action is abandoned if ctx is done.
+func (cs *controllerServer) runVolumeAction(ctx context.Context, va volumeAction, timeout int) (err error) {
+	ctx, span := tracer().Start(ctx, "volume action "+string(va.action), trace.WithAttributes(attribute.String("csi.volume", va.name), attribute.String("k8s.node.name", va.nodeName)))
+	defer func() {
+		setSpanError(span, err)
+		span.End()
+	}()
+
+	err = cs.queue.acquire(ctx, va.nodeName)
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("waiting for other volume actions on node %s: %v", va.nodeName, err))
+	}
+	defer cs.queue.release(va.nodeName)
+	span.AddEvent("node slot acquired")
+
+	start := time.Now()
+	err = cs.executeVolumeAction(ctx, va, timeout)
+	volumeActionDuration.WithLabelValues(string(va.action), status.Code(err).String()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		cs.volumeActionFailed(va, err)
+	}
+	return err
+}
+
+func (cs *controllerServer) executeVolumeAction(ctx context.Context, va volumeAction, timeout int) error {
+	va.podTemplate = cs.podTemplate
+	if cs.agentToken == "" || cs.agentTLS == nil || va.S3Parameter != (S3Parameter{}) {
+		return createProvisionerJob(ctx, va, timeout)
+	}
+	inv, err := getInventory(cs.kubeClient, cs.namespace, va.nodeName)
+	switch {
+	case err != nil:
+		klog.Warningf("unable to read lvm inventory of node %s, using provisioner job: %v", va.nodeName, err)
+	case inv.Agent == "":
+		klog.Warningf("no agent on node %s, using provisioner job", va.nodeName)
+	case inv.isStale(cs.inventoryInterval):
+		klog.Warningf("lvm inventory of node %s is outdated, using provisioner job", va.nodeName)
+	default:
+		err := callAgent(ctx, inv.Agent, cs.agentToken, cs.agentTLS.client, va, timeout)
+		if status.Code(err) != codes.Unavailable {
+			if err != nil {
+				klog.Errorf("%s of volume %s on node %s failed: %v", va.action, va.name, va.nodeName, err)
+				return err
+			}
+			klog.Infof("%s for volume %s on %v was successful", va.action, va.name, va.nodeName)
+			return nil
+		}
+		klog.Warningf("agent of node %s not available, using provisioner job: %v", va.nodeName, err)
+	}
+	return createProvisionerJob(ctx, va, timeout)
+}
@@ -0,0 +1,190 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// incompleteTag marks a cloned volume until all data has been copied
+	incompleteTag = "lv.metal-stack.io/csi-lvm-incomplete"
+
+	copyBufferSize = 4 * mib
+)
+
+// CloneLVS creates the volume name as a copy of the volume source.
+// Thin volumes are cloned with a thin snapshot, all others are copied block by block from a
+// temporary lvm snapshot of the source. Copy on write snapshots are copied directly.
+func CloneLVS(ctx context.Context, vg string, source string, name string, size uint64, lvmType string, lvmSnapshotBufferPercentage int, extraTags ...string) (string, error) {
+	src, err := getLV(vg, source)
+	if err != nil {
+		return "", err
+	}
+	if src.isMerging() {
+		return "", fmt.Errorf("logical volume %s: %w", source, ErrVolumeMerging)
+	}
+	if size < uint64(src.Size) {
+		return "", fmt.Errorf("size %d of clone %s is smaller than size %d of source %s", size, name, src.Size, source)
+	}
+
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		lv, err := getLV(vg, name)
+		if err != nil {
+			return "", err
+		}
+		if !lv.hasTag(incompleteTag) {
+			klog.Infof("logicalvolume: %s already exists\n", name)
+			return name, nil
+		}
+		// a previous attempt was interrupted, start over
+		klog.Infof("removing incomplete clone %s", name)
+		out, err := RemoveLVS(ctx, vg, name)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	if src.isThin() {
+		args := []string{"-q", "-s", "-k", "n", "-n", name, "--add-tag", lvmDriverTag, "--add-tag", incompleteTag}
+		for _, tag := range extraTags {
+			args = append(args, "--add-tag", tag)
+		}
+		args = append(args, fmt.Sprintf("%s/%s", vg, source))
+		klog.Infof("lvcreate %s", args)
+		out, err := lvmCommand(ctx, "lvcreate", args...)
+		if err != nil {
+			return string(out), err
+		}
+	} else {
+		out, err := CreateLVS(ctx, vg, name, size, lvmType, append([]string{incompleteTag}, extraTags...)...)
+		if err != nil {
+			return out, err
+		}
+
+		copySource := source
+		if !src.isSnapshot() {
+			// copy from a snapshot to get a consistent state of a volume in use
+			copySource = "c-" + name
+			stale, err := lvExists(vg, copySource)
+			if err != nil {
+				return "", err
+			}
+			if stale {
+				out, err := DeleteLVMSnapshot(ctx, vg, copySource)
+				if err != nil {
+					return out, err
+				}
+			}
+			out, err := CreateLVMSnapshot(ctx, vg, source, copySource, uint64(float64(src.Size)*float64(lvmSnapshotBufferPercentage)/100))
+			if err != nil {
+				return out, err
+			}
+			defer func() {
+				out, err := DeleteLVMSnapshot(ctx, vg, copySource)
+				if err != nil {
+					klog.Errorf("unable to remove temporary snapshot %s: %v %s", copySource, err, out)
+				}
+			}()
+		}
+
+		err = copyBlockDevice(ctx, lvPath(vg, copySource), lvPath(vg, name), src.Size)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if size > uint64(src.Size) {
+		fsType := blkidFSType(lvPath(vg, name))
+		if src.isThin() {
+			out, err := extendLVS(ctx, vg, name, size, true)
+			if err != nil {
+				return out, err
+			}
+		}
+		if fsType != "" {
+			klog.Infof("fsadm resize %s", lvPath(vg, name))
+			out, err := runCommand(ctx, exec.Command("fsadm", "-y", "resize", lvPath(vg, name)))
+			if err != nil {
+				return string(out), fmt.Errorf("unable to resize %s filesystem of %s: %v", fsType, name, err)
+			}
+		}
+	}
+
+	args := []string{"--deltag", incompleteTag, fmt.Sprintf("%s/%s", vg, name)}
+	klog.Infof("lvchange %s", args)
+	out, err := lvmCommand(ctx, "lvchange", args...)
+	if err != nil {
+		return string(out), err
+	}
+	return fmt.Sprintf("volume %s successfully cloned to %s", source, name), nil
+}
+
+func lvPath(vg string, name string) string {
+	return fmt.Sprintf("/dev/%s/%s", vg, name)
+}
+
+// blkidFSType returns the filesystem on the given device, or an empty string if there is none
+func blkidFSType(device string) string {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// copyBlockDevice copies size bytes from device src to device dst
+func copyBlockDevice(ctx context.Context, src string, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	klog.Infof("copy %d bytes from %s to %s", size, src, dst)
+	buf := make([]byte, copyBufferSize)
+	var copied int64
+	lastReport := time.Now()
+	for copied < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return fmt.Errorf("unable to write to %s: %v", dst, err)
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read from %s: %v", src, err)
+		}
+		if time.Since(lastReport) > 10*time.Second {
+			klog.Infof("copied %d of %d bytes (%d%%)", copied, size, copied*100/size)
+			lastReport = time.Now()
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("unable to sync %s: %v", dst, err)
+	}
+	klog.Infof("copied %d bytes from %s to %s", copied, src, dst)
+	return nil
+}
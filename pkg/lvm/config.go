@@ -0,0 +1,324 @@
+package lvm
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// configReloadInterval in which the configuration file is checked for changes
+const configReloadInterval = 10 * time.Second
+
+// vgNamePattern are the names lvm accepts for volume groups
+var vgNamePattern = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+// Config of the plugin, read from a yaml file with flags as overrides
+type Config struct {
+	DriverName       string `json:"driverName"`
+	NodeID           string `json:"nodeID"`
+	Endpoint         string `json:"endpoint"`
+	Ephemeral        bool   `json:"ephemeral"`
+	DevicesPattern   string `json:"devices"`
+	VGName           string `json:"vgName"`
+	Namespace        string `json:"namespace"`
+	ProvisionerImage string `json:"provisionerImage"`
+	// PullPolicy of the provisioner image, always or ifnotpresent
+	PullPolicy                  string          `json:"pullPolicy"`
+	LvmSnapshotBufferPercentage int             `json:"lvmSnapshotBufferPercentage"`
+	InventoryInterval           int             `json:"inventoryInterval"`
+	PlacementPolicy             string          `json:"placementPolicy"`
+	MetricsAddress              string          `json:"metricsAddress"`
+	LivenessAddress             string          `json:"livenessAddress"`
+	OrphanInterval              int             `json:"orphanGCInterval"`
+	OrphanGracePeriod           metav1.Duration `json:"orphanGCGracePeriod"`
+	OrphanDelete                bool            `json:"orphanGCDelete"`
+	TrashRetention              metav1.Duration `json:"trashRetention"`
+	TrimInterval                metav1.Duration `json:"trimInterval"`
+	AgentAddress                string          `json:"agentAddress"`
+	AgentAdvertiseAddress       string          `json:"agentAdvertiseAddress"`
+	AgentTokenFile              string          `json:"agentTokenFile"`
+	AgentTLSDir                 string          `json:"agentTLSDir"`
+	ProvisionerPodTemplate      string          `json:"provisionerPodTemplate"`
+	MaxNodeOperations           int             `json:"maxNodeOperations"`
+	OTLPEndpoint                string          `json:"otlpEndpoint"`
+
+	Settings `json:",inline"`
+}
+
+// Settings of the configuration which are applied without restart when the configuration file changes
+type Settings struct {
+	LVMTimeout      int `json:"lvmTimeout"`
+	SnapshotTimeout int `json:"snapshotTimeout"`
+	WipeTimeout     int `json:"wipeTimeout"`
+	LogLevel        int `json:"logLevel"`
+}
+
+// DefaultConfig returns the configuration without file and flags
+func DefaultConfig() Config {
+	return Config{
+		DriverName:                  "lvm.csi.k8s.io",
+		Endpoint:                    "unix://tmp/csi.sock",
+		VGName:                      "csi-lvm",
+		Namespace:                   "csi-lvm",
+		ProvisionerImage:            "metalstack/csi-lvmplugin-provisioner",
+		PullPolicy:                  pullIfNotPresent,
+		LvmSnapshotBufferPercentage: 10,
+		InventoryInterval:           30,
+		PlacementPolicy:             placementMostFree,
+		OrphanInterval:              300,
+		OrphanGracePeriod:           metav1.Duration{Duration: 24 * time.Hour},
+		MaxNodeOperations:           2,
+		Settings: Settings{
+			LVMTimeout:      60,
+			SnapshotTimeout: 3600,
+			WipeTimeout:     3600,
+		},
+	}
+}
+
+// BindFlags registers the flags of the configuration options in fs, their defaults are the values of c
+func BindFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Endpoint, "endpoint", c.Endpoint, "CSI endpoint")
+	fs.StringVar(&c.DriverName, "drivername", c.DriverName, "name of the driver")
+	fs.StringVar(&c.NodeID, "nodeid", c.NodeID, "node id")
+	fs.BoolVar(&c.Ephemeral, "ephemeral", c.Ephemeral, "publish volumes in ephemeral mode even if kubelet did not ask for it (only needed for Kubernetes 1.15)")
+	fs.StringVar(&c.DevicesPattern, "devices", c.DevicesPattern, "comma-separated grok patterns of the physical volumes to use.")
+	fs.StringVar(&c.VGName, "vgname", c.VGName, "name of volume group")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "name of namespace")
+	fs.StringVar(&c.ProvisionerImage, "provisionerimage", c.ProvisionerImage, "name of provisioner image")
+	fs.StringVar(&c.PullPolicy, "pullpolicy", c.PullPolicy, "pull policy for provisioner image")
+	fs.IntVar(&c.LVMTimeout, "lvm-timeout", c.LVMTimeout, "timeout for lvm provisioner operations (lvcreate/lvremove)")
+	fs.IntVar(&c.SnapshotTimeout, "snapshot-timeout", c.SnapshotTimeout, "timeout for snapshot provisioner operations (snapshot create/restore")
+	fs.IntVar(&c.LvmSnapshotBufferPercentage, "lvm-snapshot-buffer-percentage", c.LvmSnapshotBufferPercentage, "amount (in percent) for lvm snapshots during snapshot creation")
+	fs.IntVar(&c.InventoryInterval, "inventory-interval", c.InventoryInterval, "interval (in seconds) in which the lvm inventory of the node is published")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", c.MetricsAddress, "address to serve prometheus metrics on, e.g. :9899, disabled if empty")
+	fs.StringVar(&c.LivenessAddress, "liveness-address", c.LivenessAddress, "address to serve /livez for the liveness probe on, e.g. :9896, disabled if empty")
+	fs.IntVar(&c.OrphanInterval, "orphan-gc-interval", c.OrphanInterval, "interval (in seconds) in which logical volumes without persistent volume are searched, 0 disables the search")
+	fs.DurationVar(&c.OrphanGracePeriod.Duration, "orphan-gc-grace-period", c.OrphanGracePeriod.Duration, "time after which orphaned logical volumes are removed if --orphan-gc-delete is set")
+	fs.BoolVar(&c.OrphanDelete, "orphan-gc-delete", c.OrphanDelete, "remove orphaned logical volumes after the grace period, otherwise they are only reported")
+	fs.DurationVar(&c.TrashRetention.Duration, "trash-retention", c.TrashRetention.Duration, "keep the logical volumes of deleted volumes in the trash for this duration, disabled if 0")
+	fs.IntVar(&c.WipeTimeout, "wipe-timeout", c.WipeTimeout, "additional timeout (in seconds) for wiping volumes with a wipe policy before their removal")
+	fs.DurationVar(&c.TrimInterval.Duration, "trim-interval", c.TrimInterval.Duration, "interval in which mounted filesystem volumes are trimmed, can be overridden by the storage class parameter trimInterval, disabled if 0")
+	fs.StringVar(&c.AgentAddress, "agent-address", c.AgentAddress, "address to serve the agent on, e.g. :9897, which executes lvm operations of the controller without provisioner jobs, disabled if empty")
+	fs.StringVar(&c.AgentAdvertiseAddress, "agent-advertise-address", c.AgentAdvertiseAddress, "address the controller connects to the agent of this node, e.g. $(POD_IP):9897")
+	fs.StringVar(&c.AgentTokenFile, "agent-token-file", c.AgentTokenFile, "file containing the token shared by agents and controller, provisioner jobs are used without")
+	fs.StringVar(&c.AgentTLSDir, "agent-tls-dir", c.AgentTLSDir, "directory containing ca.crt, tls.crt and tls.key, agents and controller authenticate each other with certificates of this ca")
+	fs.StringVar(&c.ProvisionerPodTemplate, "provisioner-pod-template", c.ProvisionerPodTemplate, "yaml file with a pod template merged into the pods of provisioner jobs, e.g. for resources, priority class or image pull secrets")
+	fs.IntVar(&c.MaxNodeOperations, "max-node-operations", c.MaxNodeOperations, "maximum number of lvm operations the controller runs concurrently on a node, unlimited if 0")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "OTLP gRPC endpoint to export traces to, e.g. otel-collector:4317, passed on to the provisioner, disabled if empty")
+	fs.StringVar(&c.PlacementPolicy, "placement-policy", c.PlacementPolicy, "default policy to select the node of volumes with immediate binding: most-free, least-free or spread")
+	fs.IntVar(&c.LogLevel, "log-level", c.LogLevel, "verbosity of the log")
+}
+
+// LoadConfig returns the default configuration overridden by the yaml file at path, if not empty, and by the flags
+// set in flags. The configuration is validated.
+func LoadConfig(path string, flags *flag.FlagSet) (Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("unable to read configuration file %s: %v", path, err)
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return config, fmt.Errorf("invalid configuration file %s: %v", path, err)
+		}
+	}
+	if flags != nil {
+		overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+		BindFlags(overrides, &config)
+		var errs []error
+		flags.Visit(func(f *flag.Flag) {
+			if overrides.Lookup(f.Name) == nil {
+				return
+			}
+			if err := overrides.Set(f.Name, f.Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("invalid flag %s: %v", f.Name, err))
+			}
+		})
+		if len(errs) > 0 {
+			return config, utilerrors.NewAggregate(errs)
+		}
+	}
+	return config, config.Validate()
+}
+
+// Validate returns all invalid options of the configuration
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.DriverName == "" {
+		invalid("no driver name provided")
+	}
+	if c.NodeID == "" {
+		invalid("no node id provided")
+	}
+	if c.Endpoint == "" {
+		invalid("no driver endpoint provided")
+	} else if _, _, err := parseEndpoint(c.Endpoint); err != nil {
+		invalid("%v", err)
+	}
+	if !vgNamePattern.MatchString(c.VGName) || c.VGName == "." || c.VGName == ".." {
+		invalid("invalid volume group name %q", c.VGName)
+	}
+	for _, pattern := range strings.Split(c.DevicesPattern, ",") {
+		if _, err := filepath.Match(strings.TrimSpace(pattern), ""); err != nil {
+			invalid("invalid devices pattern %q: %v", pattern, err)
+		}
+	}
+	if c.Namespace == "" {
+		invalid("no namespace provided")
+	}
+	if c.ProvisionerImage == "" {
+		invalid("no provisioner image provided")
+	}
+	switch strings.ToLower(c.PullPolicy) {
+	case pullAlways, pullIfNotPresent:
+	default:
+		invalid("invalid pull policy %q, must be always or ifnotpresent", c.PullPolicy)
+	}
+	if _, err := newPlacementPolicy(c.PlacementPolicy); err != nil {
+		invalid("%v", err)
+	}
+
+	if c.LvmSnapshotBufferPercentage < 1 || c.LvmSnapshotBufferPercentage > 100 {
+		invalid("lvm snapshot buffer percentage %d is not between 1 and 100", c.LvmSnapshotBufferPercentage)
+	}
+	if c.InventoryInterval <= 0 {
+		invalid("inventory interval must be positive")
+	}
+	if c.OrphanInterval < 0 {
+		invalid("orphan gc interval must not be negative")
+	}
+	if c.OrphanGracePeriod.Duration < 0 || c.TrashRetention.Duration < 0 || c.TrimInterval.Duration < 0 {
+		invalid("orphan gc grace period, trash retention and trim interval must not be negative")
+	}
+	if c.MaxNodeOperations < 0 {
+		invalid("max node operations must not be negative")
+	}
+
+	if c.AgentAddress != "" && c.AgentTokenFile == "" {
+		invalid("the agent requires a token")
+	}
+	if c.AgentTokenFile != "" && c.AgentTLSDir == "" {
+		invalid("the agent requires tls certificates")
+	}
+	if c.AgentAddress != "" && c.AgentAdvertiseAddress == "" {
+		invalid("no agent advertise address provided")
+	}
+
+	if err := c.Settings.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// provisionerPullPolicy returns the pull policy of the provisioner image
+func (c Config) provisionerPullPolicy() v1.PullPolicy {
+	if strings.ToLower(c.PullPolicy) == pullIfNotPresent {
+		return v1.PullIfNotPresent
+	}
+	return v1.PullAlways
+}
+
+func (s Settings) validate() error {
+	var errs []error
+	if s.LVMTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("lvm timeout must be positive"))
+	}
+	if s.SnapshotTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("snapshot timeout must be positive"))
+	}
+	if s.WipeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("wipe timeout must not be negative"))
+	}
+	if s.LogLevel < 0 {
+		errs = append(errs, fmt.Errorf("log level must not be negative"))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// liveSettings are the settings in use, they are replaced when the configuration file is reloaded
+type liveSettings struct {
+	mu       sync.RWMutex
+	settings Settings
+}
+
+func newLiveSettings(settings Settings) *liveSettings {
+	setLogLevel(settings.LogLevel)
+	return &liveSettings{settings: settings}
+}
+
+func (l *liveSettings) get() Settings {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.settings
+}
+
+func (l *liveSettings) set(settings Settings) {
+	l.mu.Lock()
+	l.settings = settings
+	l.mu.Unlock()
+	setLogLevel(settings.LogLevel)
+}
+
+// klogFlags are the flags of klog, they are registered once and kept for every reload of the log level
+var (
+	klogFlags     = flag.NewFlagSet("klog", flag.ContinueOnError)
+	klogFlagsOnce sync.Once
+)
+
+// setLogLevel sets the verbosity of klog
+func setLogLevel(level int) {
+	klogFlagsOnce.Do(func() { klog.InitFlags(klogFlags) })
+	if err := klogFlags.Set("v", strconv.Itoa(level)); err != nil {
+		klog.Errorf("unable to set log level %d: %v", level, err)
+	}
+}
+
+// WatchConfig reloads the configuration file at path when it changes, flags set in flags keep overriding it. The
+// settings are applied immediately, changes of other options require a restart.
+func (lvm *Lvm) WatchConfig(path string, flags *flag.FlagSet) {
+	last, _ := ioutil.ReadFile(path)
+	for {
+		time.Sleep(configReloadInterval)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("unable to read configuration file %s: %v", path, err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		config, err := LoadConfig(path, flags)
+		if err != nil {
+			klog.Errorf("configuration file %s changed, keeping the current configuration: %v", path, err)
+			continue
+		}
+		restart := config
+		restart.Settings = lvm.config.Settings
+		if !reflect.DeepEqual(restart, lvm.config) {
+			klog.Warningf("configuration file %s changed options which are applied after a restart", path)
+		}
+		lvm.settings.set(config.Settings)
+		klog.Infof("settings reloaded, lvm timeout:%d snapshot timeout:%d wipe timeout:%d log level:%d", config.LVMTimeout, config.SnapshotTimeout, config.WipeTimeout, config.LogLevel)
+	}
+}
@@ -0,0 +1,187 @@
+package lvm
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write configuration file: %v", err)
+	}
+	return path
+}
+
+func parseFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := DefaultConfig()
+	BindFlags(fs, &config)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("unable to parse flags %v: %v", args, err)
+	}
+	return fs
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+nodeID: node-from-file
+vgName: vg-from-file
+pullPolicy: always
+lvmTimeout: 120
+trashRetention: 1h
+`)
+	flags := parseFlags(t, "--vgname", "vg-from-flag", "--lvm-timeout", "30")
+
+	config, err := LoadConfig(path, flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the file overrides the defaults
+	if config.NodeID != "node-from-file" {
+		t.Errorf("node id %q, want the one of the file", config.NodeID)
+	}
+	if config.PullPolicy != pullAlways {
+		t.Errorf("pull policy %q, want %q of the file", config.PullPolicy, pullAlways)
+	}
+	if config.TrashRetention.Duration != time.Hour {
+		t.Errorf("trash retention %s, want 1h of the file", config.TrashRetention.Duration)
+	}
+	// set flags override the file
+	if config.VGName != "vg-from-flag" {
+		t.Errorf("volume group %q, want the one of the flag", config.VGName)
+	}
+	if config.LVMTimeout != 30 {
+		t.Errorf("lvm timeout %d, want 30 of the flag", config.LVMTimeout)
+	}
+	// options neither in the file nor in the flags keep their default
+	defaults := DefaultConfig()
+	if config.SnapshotTimeout != defaults.SnapshotTimeout || config.Namespace != defaults.Namespace {
+		t.Errorf("snapshot timeout %d and namespace %q, want the defaults", config.SnapshotTimeout, config.Namespace)
+	}
+}
+
+func TestLoadConfigUnsetFlagsKeepFile(t *testing.T) {
+	path := writeConfigFile(t, `
+nodeID: node-from-file
+inventoryInterval: 60
+`)
+	// the default of an unset flag must not override the file
+	flags := parseFlags(t, "--nodeid", "node-from-flag")
+
+	config, err := LoadConfig(path, flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.NodeID != "node-from-flag" {
+		t.Errorf("node id %q, want the one of the flag", config.NodeID)
+	}
+	if config.InventoryInterval != 60 {
+		t.Errorf("inventory interval %d, want 60 of the file", config.InventoryInterval)
+	}
+}
+
+func TestLoadConfigInvalidFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown option": "nodeID: node\nunknown: true\n",
+		"invalid yaml":   "nodeID: [node\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadConfig(writeConfigFile(t, content), nil); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		config := DefaultConfig()
+		config.NodeID = "node"
+		return config
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		errs   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "pull policy is case insensitive",
+			modify: func(c *Config) { c.PullPolicy = "IfNotPresent" },
+		},
+		{
+			name:   "invalid pull policy",
+			modify: func(c *Config) { c.PullPolicy = "never" },
+			errs:   []string{`invalid pull policy "never"`},
+		},
+		{
+			name:   "percentage too low",
+			modify: func(c *Config) { c.LvmSnapshotBufferPercentage = 0 },
+			errs:   []string{"lvm snapshot buffer percentage 0 is not between 1 and 100"},
+		},
+		{
+			name:   "percentage too high",
+			modify: func(c *Config) { c.LvmSnapshotBufferPercentage = 101 },
+			errs:   []string{"lvm snapshot buffer percentage 101 is not between 1 and 100"},
+		},
+		{
+			name:   "invalid devices pattern",
+			modify: func(c *Config) { c.DevicesPattern = "/dev/nvme[0-9n1,/dev/sd*" },
+			errs:   []string{`invalid devices pattern "/dev/nvme[0-9n1"`},
+		},
+		{
+			name:   "invalid volume group name",
+			modify: func(c *Config) { c.VGName = "csi/lvm" },
+			errs:   []string{`invalid volume group name "csi/lvm"`},
+		},
+		{
+			name:   "reserved volume group name",
+			modify: func(c *Config) { c.VGName = ".." },
+			errs:   []string{`invalid volume group name ".."`},
+		},
+		{
+			name: "all invalid options are reported",
+			modify: func(c *Config) {
+				c.NodeID = ""
+				c.PullPolicy = "never"
+				c.LVMTimeout = 0
+			},
+			errs: []string{"no node id provided", "invalid pull policy", "lvm timeout must be positive"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(&config)
+			err := config.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
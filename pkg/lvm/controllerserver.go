@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
@@ -30,7 +32,10 @@ import (
 	k8serror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -48,47 +53,85 @@ type controllerServer struct {
 	provisionerImage            string
 	pullPolicy                  v1.PullPolicy
 	namespace                   string
-	lvmTimeout                  int
-	snapshotTimeout             int
 	lvmSnapshotBufferPercentage int
+	inventoryInterval           int
+	placementPolicy             placementPolicy
+	trashRetention              time.Duration
+	// settings are reloaded from the configuration file, read them once per request
+	settings *liveSettings
+	// agentToken enables the agents of the node plugins, provisioner jobs are used without
+	agentToken string
+	// agentTLS holds the certificates to connect to the agents
+	agentTLS *agentTLSConfig
+	// podTemplate of the operator for provisioner jobs, nil for the default
+	podTemplate *v1.PodTemplateSpec
+
+	recorder record.EventRecorder
+	// locks of the volumes and snapshots with an operation in progress
+	locks *volumeLocks
+	// queue limits the concurrent volume actions per node
+	queue *nodeQueue
+	// pvs are the cached persistent volumes for the periodic loops
+	pvs *pvCache
 }
 
 // NewControllerServer
-func newControllerServer(ephemeral bool, nodeID string, devicesPattern string, vgName string, namespace string, provisionerImage string, pullPolicy v1.PullPolicy, lvmTimeout int, snapshotTimeout int, lvmSnapshotBufferPercentage int) *controllerServer {
-	if ephemeral {
-		return &controllerServer{caps: getControllerServiceCapabilities(nil), nodeID: nodeID}
+func newControllerServer(config Config, settings *liveSettings, agentToken string, agentTLS *agentTLSConfig, podTemplate *v1.PodTemplateSpec) *controllerServer {
+	if config.Ephemeral {
+		return &controllerServer{caps: getControllerServiceCapabilities(nil), nodeID: config.NodeID, settings: settings, locks: newVolumeLocks(), queue: newNodeQueue(0)}
+	}
+	// the policy was validated with the configuration
+	placementPolicy, err := newPlacementPolicy(config.PlacementPolicy)
+	if err != nil {
+		panic(err.Error())
 	}
 
-	config, err := rest.InClusterConfig()
+	restConfig, err := rest.InClusterConfig()
 	if err != nil {
 		panic(err.Error())
 	}
 	// creates the clientset
-	kubeClient, err := kubernetes.NewForConfig(config)
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		panic(err.Error())
 	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 	return &controllerServer{
 		caps: getControllerServiceCapabilities(
 			[]csi.ControllerServiceCapability_RPC_Type{
 				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 
 				// TODO
-				//				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 				//				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 			}),
-		nodeID:                      nodeID,
-		devicesPattern:              devicesPattern,
-		vgName:                      vgName,
+		nodeID:                      config.NodeID,
+		devicesPattern:              config.DevicesPattern,
+		vgName:                      config.VGName,
 		kubeClient:                  *kubeClient,
-		namespace:                   namespace,
-		provisionerImage:            provisionerImage,
-		pullPolicy:                  pullPolicy,
-		lvmTimeout:                  lvmTimeout,
-		snapshotTimeout:             snapshotTimeout,
-		lvmSnapshotBufferPercentage: lvmSnapshotBufferPercentage,
+		namespace:                   config.Namespace,
+		provisionerImage:            config.ProvisionerImage,
+		pullPolicy:                  config.provisionerPullPolicy(),
+		lvmSnapshotBufferPercentage: config.LvmSnapshotBufferPercentage,
+		inventoryInterval:           config.InventoryInterval,
+		placementPolicy:             placementPolicy,
+		trashRetention:              config.TrashRetention.Duration,
+		settings:                    settings,
+		agentToken:                  agentToken,
+		agentTLS:                    agentTLS,
+		podTemplate:                 podTemplate,
+		recorder:                    broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: config.DriverName, Host: config.NodeID}),
+		locks:                       newVolumeLocks(),
+		queue:                       newNodeQueue(config.MaxNodeOperations),
+		pvs:                         newPVCache(kubeClient),
 	}
 }
 
@@ -102,6 +145,10 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
+	if err := cs.locks.tryAcquire(req.GetName(), "CreateVolume"); err != nil {
+		return nil, err
+	}
+	defer cs.locks.release(req.GetName())
 	caps := req.GetVolumeCapabilities()
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
@@ -124,7 +171,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	// TODO
-	// this check must bei implemented in createlvs executed by the provisioner pod on the node
+	// this check must bei implemented in createlvs executed by the provisioner job on the node
 
 	// Check for maximum available capacity
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
@@ -136,14 +183,23 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if !(lvmType == "linear" || lvmType == "mirror" || lvmType == "striped") {
 		return nil, status.Errorf(codes.Internal, "lvmType is incorrect: %s", lvmType)
 	}
+	wipePolicy := req.GetParameters()[wipePolicyParameter]
+	if err := ValidateWipePolicy(wipePolicy); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateTrimParameters(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	volumeContext := req.GetParameters()
 	size := strconv.FormatInt(req.GetCapacityRange().GetRequiredBytes(), 10)
 
 	volumeContext["RequiredBytes"] = size
 
-	// schedulded node of the pod is the first entry in the preferred segment
-	node := req.GetAccessibilityRequirements().GetPreferred()[0].GetSegments()[topologyKeyNode]
+	node, err := cs.selectNode(req, lvmType)
+	if err != nil {
+		return nil, err
+	}
 	topology := []*csi.Topology{{
 		Segments: map[string]string{topologyKeyNode: node},
 	}}
@@ -162,9 +218,72 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		namespace:                   cs.namespace,
 		vgName:                      cs.vgName,
 		lvmSnapshotBufferPercentage: cs.lvmSnapshotBufferPercentage,
+		wipePolicy:                  wipePolicy,
+		pvc:                         cs.claimReference(req.GetParameters()),
+	}
+	settings := cs.settings.get()
+	timeout := settings.LVMTimeout
+
+	// a clone is created by the provisioner job from the source volume, which must be on the same node
+	if sourceVolume := req.GetVolumeContentSource().GetVolume(); sourceVolume != nil {
+		inv, lv, err := cs.findVolume(sourceVolume.GetVolumeId())
+		if err != nil {
+			return nil, err
+		}
+		// the source volume must not be deleted while it is cloned
+		if err := cs.locks.tryAcquire(lv.Name, "CreateVolume"); err != nil {
+			return nil, err
+		}
+		defer cs.locks.release(lv.Name)
+		if err := cs.checkRollback(lv.Name); err != nil {
+			return nil, err
+		}
+		if inv.Node != node {
+			return nil, status.Errorf(codes.ResourceExhausted, "source volume %s of clone %s is located on node %s, not on %s", sourceVolume.GetVolumeId(), req.GetName(), inv.Node, node)
+		}
+		if capacity < lv.Size {
+			return nil, status.Errorf(codes.OutOfRange, "requested capacity %d of clone %s is smaller than source volume size %d", capacity, req.GetName(), lv.Size)
+		}
+		va.action = actionTypeClone
+		va.sourceName = lv.Name
+		timeout = settings.SnapshotTimeout
 	}
-	if err := createProvisionerPod(va, cs.lvmTimeout); err != nil {
-		klog.Errorf("error creating provisioner pod :%v", err)
+
+	// local snapshots are restored like a clone of the snapshot volume
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil && isLocalSnapshotID(snapshot.GetSnapshotId()) {
+		snap, err := parseLocalSnapshotID(snapshot.GetSnapshotId())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		// the snapshot must not be deleted while it is restored
+		if err := cs.locks.tryAcquire(snapshotLockKey(snap.name()), "CreateVolume"); err != nil {
+			return nil, err
+		}
+		defer cs.locks.release(snapshotLockKey(snap.name()))
+		if snap.node != node {
+			return nil, status.Errorf(codes.ResourceExhausted, "snapshot %s of volume %s is located on node %s, not on %s", snapshot.GetSnapshotId(), req.GetName(), snap.node, node)
+		}
+		inv, err := getInventory(cs.kubeClient, cs.namespace, snap.node)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to read lvm inventory of node %s: %v", snap.node, err)
+		}
+		lv := inv.findLV(snap.lvName)
+		if lv == nil {
+			return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshot.GetSnapshotId())
+		}
+		if capacity < lv.Size {
+			return nil, status.Errorf(codes.OutOfRange, "requested capacity %d of volume %s is smaller than snapshot size %d", capacity, req.GetName(), lv.Size)
+		}
+		va.action = actionTypeClone
+		va.sourceName = snap.lvName
+		va.vgName = snap.vgName
+		timeout = settings.SnapshotTimeout
+	}
+	// the id carries the volume group the lv is created in, which is the one of the snapshot for restores
+	volID := volumeID{node: node, vgName: va.vgName, lvName: req.GetName()}
+
+	if err := cs.runVolumeAction(ctx, va, timeout); err != nil {
+		klog.Errorf("error creating provisioner job :%v", err)
 		return nil, err
 	}
 
@@ -172,7 +291,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		volumeSource := req.VolumeContentSource
 		switch volumeSource.Type.(type) {
 		case *csi.VolumeContentSource_Snapshot:
-			if snapshot := volumeSource.GetSnapshot(); snapshot != nil {
+			if snapshot := volumeSource.GetSnapshot(); snapshot != nil && !isLocalSnapshotID(snapshot.GetSnapshotId()) {
 				s3, err := secretsToS3Parameter(req.Secrets)
 				klog.Infof("restore secrets: %v", req)
 				if err != nil {
@@ -191,12 +310,15 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 					snapshotName:                snapshot.GetSnapshotId(),
 					S3Parameter:                 s3,
 					lvmSnapshotBufferPercentage: cs.lvmSnapshotBufferPercentage,
+					pvc:                         va.pvc,
 				}
-				if err := createProvisionerPod(va, cs.snapshotTimeout); err != nil {
-					klog.Errorf("error creating provisioner pod :%v", err)
+				if err := cs.runVolumeAction(ctx, va, settings.SnapshotTimeout); err != nil {
+					klog.Errorf("error creating provisioner job :%v", err)
 					return nil, err
 				}
 			}
+		case *csi.VolumeContentSource_Volume:
+			// already cloned by the provisioner job
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "%v not a proper volume source", volumeSource)
 		}
@@ -205,7 +327,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:           req.GetName(),
+			VolumeId:           volID.String(),
 			CapacityBytes:      req.GetCapacityRange().GetRequiredBytes(),
 			VolumeContext:      volumeContext,
 			ContentSource:      req.GetVolumeContentSource(),
@@ -225,43 +347,68 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, err
 	}
 
-	volID := req.GetVolumeId()
-
-	volume, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), volID, metav1.GetOptions{})
+	// volumes are locked by the lv name, which is the name of the create request
+	lockID, err := parseVolumeID(req.GetVolumeId())
 	if err != nil {
-		panic(err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := cs.locks.tryAcquire(lockID.lvName, "DeleteVolume"); err != nil {
+		return nil, err
+	}
+	defer cs.locks.release(lockID.lvName)
+	if err := cs.checkRollback(lockID.lvName); err != nil {
+		return nil, err
 	}
-	klog.V(4).Infof("volume %s to be deleted", volume)
-	ns := volume.Spec.NodeAffinity.Required.NodeSelectorTerms
-	node := ns[0].MatchExpressions[0].Values[0]
 
-	_, err = cs.kubeClient.CoreV1().Nodes().Get(context.Background(), node, metav1.GetOptions{})
+	volID, err := cs.resolveVolumeID(req.GetVolumeId())
+	if status.Code(err) == codes.NotFound {
+		klog.Infof("volume %s not found. Assuming it is gone.", req.GetVolumeId())
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 	if err != nil {
+		return nil, err
+	}
+	node := volID.node
 
-		// TODO: DEBUG output, remove later
-		klog.Infof("not found %s", k8serror.IsNotFound(err))
-		klog.Infof("is gone %s", k8serror.IsGone(err))
-		klog.Infof("is invalid %s", k8serror.IsInvalid(err))
-		if k8serror.IsNotFound(err) || k8serror.IsGone(err) || k8serror.IsInvalid(err) {
-			klog.V(4).Infof("node %s not found. Assuming volume %s is gone.", node, volID)
-			return &csi.DeleteVolumeResponse{}, nil
+	// lvm removes copy on write snapshots together with their origin, the provisioner checks it again
+	if inv, err := getInventory(cs.kubeClient, cs.namespace, node); err == nil {
+		if snapshots := localSnapshotsOf(inv.LVs, volID.lvName); len(snapshots) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s has local snapshots %s, delete them first", volID, strings.Join(snapshots, ","))
 		}
 	}
 
+	ready, err := nodeReady(cs.kubeClient, node)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to get node %s: %v", node, err)
+	}
+	if !ready {
+		// the provisioner job would never run, the node plugin removes the volume when the node is back
+		if err := addPendingDeletion(cs.kubeClient, cs.namespace, volID); err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to record deletion of volume %s: %v", volID, err)
+		}
+		klog.Infof("node %s is not ready, deletion of volume %s deferred until it is back", node, volID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
 	klog.V(4).Infof("from node %s ", node)
 
+	settings := cs.settings.get()
 	va := volumeAction{
 		action:           actionTypeDelete,
-		name:             req.GetVolumeId(),
+		name:             volID.lvName,
 		nodeName:         node,
 		pullPolicy:       cs.pullPolicy,
 		provisionerImage: cs.provisionerImage,
 		kubeClient:       cs.kubeClient,
 		namespace:        cs.namespace,
-		vgName:           cs.vgName,
+		vgName:           volID.vgName,
+		trashRetention:   cs.trashRetention,
+		wipeTimeout:      settings.WipeTimeout,
+		pvc:              cs.volumeClaimReference(volID.lvName),
 	}
-	if err := createProvisionerPod(va, cs.lvmTimeout); err != nil {
-		klog.Errorf("error creating provisioner pod :%v", err)
+	// the timeout is an upper bound, volumes without wipe policy are removed quickly
+	if err := cs.runVolumeAction(ctx, va, settings.LVMTimeout+settings.WipeTimeout); err != nil {
+		klog.Errorf("error creating provisioner job :%v", err)
 		return nil, err
 	}
 
@@ -345,12 +492,105 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// GetCapacity returns the free space of the volume group of the requested node, or of all nodes without topology.
+// Trashed volumes are not counted as free, they are only reclaimed if a volume does not fit otherwise.
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		klog.V(3).Infof("invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	node := req.GetAccessibleTopology().GetSegments()[topologyKeyNode]
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
+	}
+	var capacity int64
+	for _, inv := range invs {
+		if node != "" && inv.Node != node {
+			continue
+		}
+		if inv.isStale(cs.inventoryInterval) || inv.VG == nil {
+			continue
+		}
+		capacity += inv.VG.Free
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: capacity}, nil
 }
 
 func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		klog.Infof("invalid list volumes req: %v", req)
+		return nil, err
+	}
+
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
+	}
+
+	var volumes []*csi.ListVolumesResponse_Entry
+	for _, inv := range invs {
+		stale := inv.isStale(cs.inventoryInterval)
+		for _, lv := range inv.volumes() {
+			volumes = append(volumes, &csi.ListVolumesResponse_Entry{
+				Volume: lvToVolume(inv.Node, lv),
+				Status: &csi.ListVolumesResponse_VolumeStatus{
+					PublishedNodeIds: publishedNodeIDs(inv.Node, lv),
+					VolumeCondition:  volumeCondition(inv.Node, lv, stale),
+				},
+			})
+		}
+	}
+
+	var (
+		ulenVolumes   = int32(len(volumes))
+		maxEntries    = req.MaxEntries
+		startingToken int32
+	)
+
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "maxEntries=%d < 0", maxEntries)
+	}
+
+	if v := req.StartingToken; v != "" {
+		i, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || i < 0 {
+			return nil, status.Errorf(
+				codes.Aborted,
+				"startingToken=%s !< int32=%d",
+				v, math.MaxInt32)
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken > ulenVolumes {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"startingToken=%d > len(volumes)=%d",
+			startingToken, ulenVolumes)
+	}
+
+	// Discern the number of remaining entries.
+	rem := ulenVolumes - startingToken
+
+	// If maxEntries is 0 or greater than the number of remaining entries then
+	// set maxEntries to the number of remaining entries.
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	entries := volumes[startingToken : startingToken+maxEntries]
+
+	var nextToken string
+	if j := startingToken + maxEntries; j < ulenVolumes {
+		nextToken = fmt.Sprintf("%d", j)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
@@ -366,6 +606,30 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	if len(req.GetSourceVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
 	}
+	if err := cs.locks.tryAcquire(snapshotLockKey(req.GetName()), "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	defer cs.locks.release(snapshotLockKey(req.GetName()))
+	// the source volume must not be deleted while it is snapshotted
+	sourceVolID, err := parseVolumeID(req.GetSourceVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := cs.locks.tryAcquire(sourceVolID.lvName, "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	defer cs.locks.release(sourceVolID.lvName)
+	if err := cs.checkRollback(sourceVolID.lvName); err != nil {
+		return nil, err
+	}
+
+	switch backend := req.GetParameters()["backend"]; backend {
+	case snapshotBackendLocal:
+		return cs.createLocalSnapshot(ctx, req)
+	case snapshotBackendS3, "":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported snapshot backend %s", backend)
+	}
 
 	s3, err := secretsToS3Parameter(req.Secrets)
 	if err != nil {
@@ -373,7 +637,7 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 	// Need to check for already existing snapshot name, and if found check for the
 	// requested sourceVolumeId and sourceVolumeId of snapshot that has been created.
-	if snapshots, err := s3ListSnapshots(req.GetName(), req.GetSourceVolumeId(), s3); err == nil && len(snapshots) == 1 {
+	if snapshots, err := s3ListSnapshots(ctx, req.GetName(), sourceVolID.lvName, s3); err == nil && len(snapshots) == 1 {
 		return &csi.CreateSnapshotResponse{
 			Snapshot: &csi.Snapshot{
 				SnapshotId:     req.GetName(),
@@ -385,33 +649,31 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		}, nil
 	}
 
-	volume, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), req.GetSourceVolumeId(), metav1.GetOptions{})
+	inv, lv, err := cs.findVolume(req.GetSourceVolumeId())
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
-	ns := volume.Spec.NodeAffinity.Required.NodeSelectorTerms
-	node := ns[0].MatchExpressions[0].Values[0]
 
 	va := volumeAction{
 		action:                      actionTypeCreateSnapshot,
-		name:                        req.GetSourceVolumeId(),
+		name:                        lv.Name,
 		snapshotName:                req.GetName(),
-		nodeName:                    node,
+		nodeName:                    inv.Node,
 		pullPolicy:                  cs.pullPolicy,
 		provisionerImage:            cs.provisionerImage,
 		kubeClient:                  cs.kubeClient,
 		namespace:                   cs.namespace,
-		vgName:                      cs.vgName,
-		size:                        int64(volume.Size()),
+		vgName:                      lv.VGName,
+		size:                        lv.Size,
 		S3Parameter:                 s3,
 		lvmSnapshotBufferPercentage: cs.lvmSnapshotBufferPercentage,
 	}
-	if err := createProvisionerPod(va, cs.snapshotTimeout); err != nil {
-		klog.Errorf("error creating provisioner pod :%v", err)
+	if err := cs.runVolumeAction(ctx, va, cs.settings.get().SnapshotTimeout); err != nil {
+		klog.Errorf("error creating provisioner job :%v", err)
 		return nil, err
 	}
 
-	snapshots, err := s3ListSnapshots(req.GetName(), req.GetSourceVolumeId(), s3)
+	snapshots, err := s3ListSnapshots(ctx, req.GetName(), lv.Name, s3)
 	if err == nil && len(snapshots) == 1 {
 		return &csi.CreateSnapshotResponse{
 			Snapshot: &csi.Snapshot{
@@ -423,11 +685,67 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 			},
 		}, nil
 	}
-	klog.Errorf("snapshot %s not found in: %v", snapshots)
+	klog.Errorf("snapshot %s not found in: %v", req.GetName(), snapshots)
 
 	return nil, fmt.Errorf("failed to create snapshot %s from volume %s", req.GetName(), req.GetSourceVolumeId())
 }
 
+// createLocalSnapshot creates a lvm snapshot which is kept on the node of the source volume
+func (cs *controllerServer) createLocalSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	inv, lv, err := cs.findVolume(req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	lvmSnapshotBufferPercentage := cs.lvmSnapshotBufferPercentage
+	if p := req.GetParameters()["lvmSnapshotBufferPercentage"]; p != "" {
+		lvmSnapshotBufferPercentage, err = strconv.Atoi(p)
+		if err != nil || lvmSnapshotBufferPercentage <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid lvmSnapshotBufferPercentage %s", p)
+		}
+	}
+
+	snap := localSnapshot{
+		node:   inv.Node,
+		vgName: lv.VGName,
+		lvName: localSnapshotLVName(req.GetName()),
+	}
+
+	va := volumeAction{
+		action:                      actionTypeCreateSnapshot,
+		name:                        lv.Name,
+		snapshotName:                req.GetName(),
+		backend:                     snapshotBackendLocal,
+		nodeName:                    snap.node,
+		pullPolicy:                  cs.pullPolicy,
+		provisionerImage:            cs.provisionerImage,
+		kubeClient:                  cs.kubeClient,
+		namespace:                   cs.namespace,
+		vgName:                      snap.vgName,
+		lvmSnapshotBufferPercentage: lvmSnapshotBufferPercentage,
+		pvc:                         cs.volumeClaimReference(lv.Name),
+	}
+	if err := cs.runVolumeAction(ctx, va, cs.settings.get().LVMTimeout); err != nil {
+		klog.Errorf("error creating provisioner job :%v", err)
+		return nil, err
+	}
+
+	creationTime := time.Now()
+	if existing := inv.findLV(snap.lvName); existing != nil && !existing.CreationTime.IsZero() {
+		creationTime = existing.CreationTime
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     snap.id(),
+			SourceVolumeId: req.GetSourceVolumeId(),
+			CreationTime:   timestamppb.New(creationTime),
+			SizeBytes:      lv.Size,
+			ReadyToUse:     true,
+		},
+	}, nil
+}
+
 func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	// Check arguments
 	if len(req.GetSnapshotId()) == 0 {
@@ -438,53 +756,106 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		klog.Infof("invalid delete snapshot req: %v", req)
 		return nil, err
 	}
+	// the snapshot is locked by its name like in CreateSnapshot, the name of s3 snapshots is their id
+	var snap *localSnapshot
+	snapshotName := req.GetSnapshotId()
+	if isLocalSnapshotID(req.GetSnapshotId()) {
+		var err error
+		snap, err = parseLocalSnapshotID(req.GetSnapshotId())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		snapshotName = snap.name()
+	}
+	if err := cs.locks.tryAcquire(snapshotLockKey(snapshotName), "DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	defer cs.locks.release(snapshotLockKey(snapshotName))
+
+	if snap != nil {
+		return &csi.DeleteSnapshotResponse{}, cs.deleteLocalSnapshot(ctx, snap)
+	}
 	s3, err := secretsToS3Parameter(req.Secrets)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = DeleteS3Snapshot(req.GetSnapshotId(), s3)
+	_, err = DeleteS3Snapshot(ctx, req.GetSnapshotId(), s3)
 	return &csi.DeleteSnapshotResponse{}, err
 }
 
+func (cs *controllerServer) deleteLocalSnapshot(ctx context.Context, snap *localSnapshot) error {
+	_, err := cs.kubeClient.CoreV1().Nodes().Get(ctx, snap.node, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		klog.Infof("node %s not found. Assuming snapshot %s is gone.", snap.node, snap.id())
+		return nil
+	}
+
+	va := volumeAction{
+		action:           actionTypeDelete,
+		name:             snap.lvName,
+		nodeName:         snap.node,
+		pullPolicy:       cs.pullPolicy,
+		provisionerImage: cs.provisionerImage,
+		kubeClient:       cs.kubeClient,
+		namespace:        cs.namespace,
+		vgName:           snap.vgName,
+	}
+	if err := cs.runVolumeAction(ctx, va, cs.settings.get().LVMTimeout); err != nil {
+		klog.Errorf("error creating provisioner job :%v", err)
+		return err
+	}
+	klog.Infof("snapshot %s successfully deleted", snap.id())
+	return nil
+}
+
 func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
 		klog.Infof("invalid list snapshot req: %v", req)
 		return nil, err
 	}
 
-	s3, err := secretsToS3Parameter(req.Secrets)
+	snapshots, err := cs.listLocalSnapshots(req.GetSnapshotId(), req.GetSourceVolumeId())
 	if err != nil {
 		return nil, err
 	}
 
-	// case 1: SnapshotId is not empty, return snapshots that match the snapshot id.
-	if len(req.GetSnapshotId()) != 0 {
-		if snapshots, err := s3ListSnapshots(req.GetSnapshotId(), "", s3); err == nil && len(snapshots) == 1 {
-			return convertSnapshot(snapshots[0]), nil
-		}
-	}
-
-	// case 2: SourceVolumeId is not empty, return snapshots that match the source volume id.
-	if len(req.GetSourceVolumeId()) != 0 {
-		if snapshots, err := s3ListSnapshots("", req.GetSourceVolumeId(), s3); err == nil && len(snapshots) == 1 {
-			return convertSnapshot(snapshots[0]), nil
-		}
-	}
-
-	// case 3: no parameter is set, so we return all the snapshots.
-	var snapshots []csi.Snapshot
-	s3snapshots, err := s3ListSnapshots("", req.GetSourceVolumeId(), s3)
-
-	for _, s := range s3snapshots {
-		snapshot := csi.Snapshot{
-			SnapshotId:     s.SnapshotName,
-			SourceVolumeId: s.VolumeName,
-			CreationTime:   timestamppb.New(s.Time),
-			SizeBytes:      s.Size,
-			ReadyToUse:     true,
+	// snapshots in s3 can only be listed if the snapshot class contains the s3 secrets
+	if !isLocalSnapshotID(req.GetSnapshotId()) {
+		s3, err := secretsToS3Parameter(req.Secrets)
+		if err != nil {
+			klog.V(4).Infof("not listing s3 snapshots: %v", err)
+		} else {
+			// s3 snapshots only know the lv name of their source volume
+			sourceVolumeID := ""
+			if req.GetSourceVolumeId() != "" {
+				v, err := parseVolumeID(req.GetSourceVolumeId())
+				if err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				sourceVolumeID = v.lvName
+			}
+			s3snapshots, err := s3ListSnapshots(ctx, req.GetSnapshotId(), sourceVolumeID, s3)
+			if err != nil {
+				klog.Errorf("unable to list s3 snapshots: %v", err)
+			} else if req.GetSnapshotId() == "" && sourceVolumeID == "" {
+				s3Snapshots.WithLabelValues(s3Repository(s3)).Set(float64(len(s3snapshots)))
+			}
+			for _, s := range s3snapshots {
+				source := s.VolumeName
+				if req.GetSourceVolumeId() != "" {
+					source = req.GetSourceVolumeId()
+				}
+				snapshot := csi.Snapshot{
+					SnapshotId:     s.SnapshotName,
+					SourceVolumeId: source,
+					CreationTime:   timestamppb.New(s.Time),
+					SizeBytes:      s.Size,
+					ReadyToUse:     true,
+				}
+				snapshots = append(snapshots, snapshot)
+			}
 		}
-		snapshots = append(snapshots, snapshot)
 	}
 
 	var (
@@ -493,13 +864,17 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 		startingToken int32
 	)
 
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "maxEntries=%d < 0", maxEntries)
+	}
+
 	if v := req.StartingToken; v != "" {
-		i, err := strconv.ParseUint(v, 10, 32)
-		if err != nil {
+		i, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || i < 0 {
 			return nil, status.Errorf(
 				codes.Aborted,
-				"startingToken=%d !< int32=%d",
-				startingToken, math.MaxUint32)
+				"startingToken=%s !< int32=%d",
+				v, math.MaxInt32)
 		}
 		startingToken = int32(i)
 	}
@@ -551,25 +926,139 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 }
 
 func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
 
-func convertSnapshot(s s3Snapshot) *csi.ListSnapshotsResponse {
-	entries := []*csi.ListSnapshotsResponse_Entry{
-		{
-			Snapshot: &csi.Snapshot{
-				SnapshotId:     s.SnapshotName,
-				SourceVolumeId: s.VolumeName,
-				CreationTime:   timestamppb.New(s.Time),
-				SizeBytes:      s.Size,
-				ReadyToUse:     true,
-			},
+	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		klog.Infof("invalid get volume req: %v", req)
+		return nil, err
+	}
+
+	inv, lv, err := cs.findVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	volume := lvToVolume(inv.Node, *lv)
+	// legacy volume ids are returned unchanged
+	volume.VolumeId = req.GetVolumeId()
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs(inv.Node, *lv),
+			VolumeCondition:  volumeCondition(inv.Node, *lv, inv.isStale(cs.inventoryInterval)),
 		},
+	}, nil
+}
+
+// findVolume looks up the logical volume of a volume in the lvm inventory of its node.
+// Legacy volume ids are searched in the inventories of all nodes.
+func (cs *controllerServer) findVolume(id string) (*nodeInventory, *LogicalVolume, error) {
+	volID, err := parseVolumeID(id)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !volID.isLegacy() {
+		inv, err := getInventory(cs.kubeClient, cs.namespace, volID.node)
+		if k8serror.IsNotFound(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "volume %s not found, no lvm inventory of node %s", id, volID.node)
+		}
+		if err != nil {
+			return nil, nil, status.Errorf(codes.Internal, "unable to read lvm inventory of node %s: %v", volID.node, err)
+		}
+		lv := inv.findLV(volID.lvName)
+		if lv == nil || !volID.matches(inv.Node, *lv) {
+			return nil, nil, status.Errorf(codes.NotFound, "volume %s not found", id)
+		}
+		return inv, lv, nil
+	}
+
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
 	}
 
-	rsp := &csi.ListSnapshotsResponse{
-		Entries: entries,
+	for i := range invs {
+		for _, lv := range invs[i].volumes() {
+			if volID.matches(invs[i].Node, lv) {
+				lv := lv
+				return &invs[i], &lv, nil
+			}
+		}
 	}
+	return nil, nil, status.Errorf(codes.NotFound, "volume %s not found", id)
+}
 
-	return rsp
+func lvToVolume(node string, lv LogicalVolume) *csi.Volume {
+	return &csi.Volume{
+		VolumeId:      volumeID{node: node, vgName: lv.VGName, lvName: lv.Name}.String(),
+		CapacityBytes: lv.Size,
+		AccessibleTopology: []*csi.Topology{{
+			Segments: map[string]string{topologyKeyNode: node},
+		}},
+	}
+}
+
+// publishedNodeIDs returns the node of the volume if its device is in use
+func publishedNodeIDs(node string, lv LogicalVolume) []string {
+	if lv.isOpen() {
+		return []string{node}
+	}
+	return nil
+}
+
+func volumeCondition(node string, lv LogicalVolume, stale bool) *csi.VolumeCondition {
+	switch {
+	case stale:
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("lvm inventory of node %s is outdated, node plugin not running?", node)}
+	case lv.HealthStatus != "":
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("logical volume health: %s", lv.HealthStatus)}
+	case !lv.isActive():
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("logical volume is not active, attributes: %s", lv.Attr)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// listLocalSnapshots returns the local snapshots of all nodes, optionally filtered by snapshot id and source volume
+func (cs *controllerServer) listLocalSnapshots(snapshotID string, sourceVolumeID string) ([]csi.Snapshot, error) {
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
+	}
+
+	var source *volumeID
+	if sourceVolumeID != "" {
+		source, err = parseVolumeID(sourceVolumeID)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	var snapshots []csi.Snapshot
+	for _, inv := range invs {
+		for _, lv := range inv.LVs {
+			if !lv.hasTag(localSnapshotTag) {
+				continue
+			}
+			snap := localSnapshot{node: inv.Node, vgName: lv.VGName, lvName: lv.Name}
+			if snapshotID != "" && snap.id() != snapshotID {
+				continue
+			}
+			origin := volumeID{node: inv.Node, vgName: lv.VGName, lvName: lv.Origin}
+			if source != nil && !source.matches(inv.Node, LogicalVolume{Name: lv.Origin, VGName: lv.VGName}) {
+				continue
+			}
+			snapshots = append(snapshots, csi.Snapshot{
+				SnapshotId:     snap.id(),
+				SourceVolumeId: origin.String(),
+				CreationTime:   timestamppb.New(lv.CreationTime),
+				SizeBytes:      lv.Size,
+				ReadyToUse:     !lv.isInvalid(),
+			})
+		}
+	}
+	return snapshots, nil
 }
@@ -0,0 +1,190 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	pendingDeletionLabel  = "csi-lvm.metal-stack.io/pending-deletions"
+	pendingDeletionPrefix = "csi-lvm-pending-deletions-"
+	pendingDeletionKey    = "volumes"
+)
+
+// pendingDeletion is a volume deleted while its node was not ready or gone. The node plugin removes the
+// logical volume as soon as it runs on the node again.
+type pendingDeletion struct {
+	VolumeID  string    `json:"volumeID"`
+	VG        string    `json:"vg"`
+	LV        string    `json:"lv"`
+	Requested time.Time `json:"requested"`
+}
+
+func pendingDeletionName(node string) string {
+	return pendingDeletionPrefix + node
+}
+
+// nodeReady returns false if the node is gone or not ready, the provisioner job would never run there
+func nodeReady(kubeClient kubernetes.Clientset, node string) (bool, error) {
+	n, err := kubeClient.CoreV1().Nodes().Get(context.Background(), node, metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+// addPendingDeletion records the deletion of a volume on the given node
+func addPendingDeletion(kubeClient kubernetes.Clientset, namespace string, volID *volumeID) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, deletions, err := getPendingDeletions(kubeClient, namespace, volID.node)
+		if err != nil {
+			return err
+		}
+		for _, d := range deletions {
+			if d.VG == volID.vgName && d.LV == volID.lvName {
+				return nil
+			}
+		}
+		deletions = append(deletions, pendingDeletion{
+			VolumeID:  volID.String(),
+			VG:        volID.vgName,
+			LV:        volID.lvName,
+			Requested: time.Now(),
+		})
+		return updatePendingDeletions(kubeClient, namespace, volID.node, cm, deletions)
+	})
+}
+
+// getPendingDeletions returns the configmap and the pending deletions of the node, the configmap is nil if there are none
+func getPendingDeletions(kubeClient kubernetes.Clientset, namespace string, node string) (*v1.ConfigMap, []pendingDeletion, error) {
+	cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), pendingDeletionName(node), metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var deletions []pendingDeletion
+	if err := json.Unmarshal([]byte(cm.Data[pendingDeletionKey]), &deletions); err != nil {
+		return nil, nil, fmt.Errorf("invalid pending deletions %s: %v", cm.Name, err)
+	}
+	return cm, deletions, nil
+}
+
+// updatePendingDeletions writes the pending deletions of the node, the configmap is removed if there are none left
+func updatePendingDeletions(kubeClient kubernetes.Clientset, namespace string, node string, cm *v1.ConfigMap, deletions []pendingDeletion) error {
+	if len(deletions) == 0 {
+		if cm == nil {
+			return nil
+		}
+		err := kubeClient.CoreV1().ConfigMaps(namespace).Delete(context.Background(), cm.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &cm.ResourceVersion}})
+		if k8serror.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(deletions)
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   pendingDeletionName(node),
+				Labels: map[string]string{pendingDeletionLabel: "true"},
+			},
+			Data: map[string]string{pendingDeletionKey: string(data)},
+		}
+		_, err = kubeClient.CoreV1().ConfigMaps(namespace).Create(context.Background(), cm, metav1.CreateOptions{})
+		if k8serror.IsAlreadyExists(err) {
+			// created concurrently, retry with the current content
+			return k8serror.NewConflict(v1.Resource("configmaps"), cm.Name, err)
+		}
+		return err
+	}
+	cm.Data = map[string]string{pendingDeletionKey: string(data)}
+	_, err = kubeClient.CoreV1().ConfigMaps(namespace).Update(context.Background(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// runPendingDeletions removes the logical volumes deleted while this node was not ready every interval seconds
+func runPendingDeletions(kubeClient kubernetes.Clientset, namespace string, nodeID string, interval int, trashRetention time.Duration) {
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		err := processPendingDeletions(kubeClient, namespace, nodeID, trashRetention)
+		if err != nil {
+			klog.Errorf("unable to process pending deletions of node %s: %v", nodeID, err)
+		}
+	}
+}
+
+// processPendingDeletions removes the logical volumes deleted while this node was not ready. It is called before
+// the node plugin serves requests, a returning node must not keep volumes which are already deleted in kubernetes.
+func processPendingDeletions(kubeClient kubernetes.Clientset, namespace string, nodeID string, trashRetention time.Duration) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, deletions, err := getPendingDeletions(kubeClient, namespace, nodeID)
+		if err != nil || len(deletions) == 0 {
+			return err
+		}
+		var remaining []pendingDeletion
+		for _, d := range deletions {
+			if lv, err := getLV(d.VG, d.LV); err == nil && lv.isOpen() {
+				klog.Warningf("logical volume %s/%s of deleted volume %s is still in use, retrying later", d.VG, d.LV, d.VolumeID)
+				remaining = append(remaining, d)
+				continue
+			}
+			var out string
+			withNodeSlot(func() {
+				out, err = DeleteLV(context.Background(), d.VG, d.LV, trashRetention)
+			})
+			if err != nil {
+				klog.Errorf("unable to remove logical volume %s/%s of deleted volume %s: %v output:%s", d.VG, d.LV, d.VolumeID, err, out)
+				remaining = append(remaining, d)
+				continue
+			}
+			klog.Infof("logical volume %s/%s of volume %s deleted %s ago removed", d.VG, d.LV, d.VolumeID, time.Since(d.Requested).Round(time.Second))
+		}
+		return updatePendingDeletions(kubeClient, namespace, nodeID, cm, remaining)
+	})
+	if err != nil {
+		return err
+	}
+	return updatePendingDeletionMetrics(kubeClient, namespace)
+}
+
+// updatePendingDeletionMetrics publishes the backlog of all nodes, a node which is gone can not report its own
+func updatePendingDeletionMetrics(kubeClient kubernetes.Clientset, namespace string) error {
+	cms, err := kubeClient.CoreV1().ConfigMaps(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: pendingDeletionLabel + "=true"})
+	if err != nil {
+		return err
+	}
+	pendingDeletions.Reset()
+	for _, cm := range cms.Items {
+		var deletions []pendingDeletion
+		if err := json.Unmarshal([]byte(cm.Data[pendingDeletionKey]), &deletions); err != nil {
+			klog.Errorf("ignoring invalid pending deletions %s: %v", cm.Name, err)
+			continue
+		}
+		pendingDeletions.WithLabelValues(strings.TrimPrefix(cm.Name, pendingDeletionPrefix)).Set(float64(len(deletions)))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package lvm
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/klog/v2"
+)
+
+const volumeActionFailedReason = "VolumeActionFailed"
+
+// claimReference returns the reference of the persistent volume claim named in the parameters of a create request,
+// nil without extra create metadata
+func (cs *controllerServer) claimReference(params map[string]string) *v1.ObjectReference {
+	name := params[pvcNameParameter]
+	namespace := params[pvcNamespaceParameter]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	pvc, err := cs.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("unable to get persistent volume claim %s/%s: %v", namespace, name, err)
+		return nil
+	}
+	ref, err := reference.GetReference(scheme.Scheme, pvc)
+	if err != nil {
+		klog.Warningf("unable to reference persistent volume claim %s/%s: %v", namespace, name, err)
+		return nil
+	}
+	return ref
+}
+
+// volumeClaimReference returns the claim bound to the persistent volume, nil if there is none
+func (cs *controllerServer) volumeClaimReference(pvName string) *v1.ObjectReference {
+	pv, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pvName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("unable to get persistent volume %s: %v", pvName, err)
+		return nil
+	}
+	return pv.Spec.ClaimRef
+}
+
+// volumeActionFailed records the failure of the volume action as event on its claim
+func (cs *controllerServer) volumeActionFailed(va volumeAction, err error) {
+	if va.pvc == nil || cs.recorder == nil {
+		return
+	}
+	cs.recorder.Eventf(va.pvc, v1.EventTypeWarning, volumeActionFailedReason, "%s of volume %s on node %s failed: %v", va.action, va.name, va.nodeName, err)
+}
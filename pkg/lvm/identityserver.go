@@ -17,22 +17,27 @@ limitations under the License.
 package lvm
 
 import (
+	"strings"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
 
 type identityServer struct {
 	name    string
 	version string
+	check   *selfCheck
 }
 
-func newIdentityServer(name, version string) *identityServer {
+func newIdentityServer(name, version string, check *selfCheck) *identityServer {
 	return &identityServer{
 		name:    name,
 		version: version,
+		check:   check,
 	}
 }
 
@@ -54,7 +59,13 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	// the probe drives the readiness of the plugin, the liveness is served separately by the self check
+	problems := ids.check.problems(false)
+	if len(problems) > 0 {
+		klog.Warningf("plugin is not ready: %s", strings.Join(problems, "; "))
+		return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: false}}, nil
+	}
+	return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
@@ -0,0 +1,136 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// importAnnotation on a persistent volume requests the import of its logical volume, set by lvmctl migrate
+const importAnnotation = "csi-lvm.metal-stack.io/import"
+
+// ImportLV validates an existing logical volume and tags it as volume of this driver.
+// It returns the logical volume and the type of the filesystem on it, which is empty for raw volumes.
+func ImportLV(ctx context.Context, vg string, name string) (*LogicalVolume, string, error) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exists {
+		return nil, "", fmt.Errorf("logical volume %s not found in volumegroup %s", name, vg)
+	}
+	lv, err := getLV(vg, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case strings.HasPrefix(name, "csi-"):
+		return nil, "", fmt.Errorf("logical volume %s is reserved for ephemeral volumes, rename it before importing", name)
+	case lv.isSnapshot():
+		return nil, "", fmt.Errorf("logical volume %s is a snapshot", name)
+	case lv.isThinPool():
+		return nil, "", fmt.Errorf("logical volume %s is a thin pool", name)
+	case lv.hasTag(localSnapshotTag) || lv.hasTag(incompleteTag) || lv.isTrashed():
+		return nil, "", fmt.Errorf("logical volume %s is used internally by the driver", name)
+	}
+
+	if !lv.hasTag(lvmDriverTag) {
+		args := []string{"--addtag", lvmDriverTag, fmt.Sprintf("%s/%s", vg, name)}
+		klog.Infof("lvchange %s", args)
+		out, err := lvmCommand(ctx, "lvchange", args...)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to tag logical volume %s: %v output:%s", name, err, out)
+		}
+		lv.Tags = append(lv.Tags, lvmDriverTag)
+	}
+
+	out, err := activateLV(ctx, vg, lv)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to activate logical volume %s: %v output:%s", name, err, out)
+	}
+
+	fs := blkidFSType(lvPath(vg, name))
+	if fs == "" && partitionTableType(lvPath(vg, name)) != "" {
+		return nil, "", fmt.Errorf("logical volume %s contains a partition table, only filesystems and raw volumes can be imported", name)
+	}
+	klog.Infof("logical volume %s imported, size:%d filesystem:%s", name, lv.Size, fs)
+	return lv, fs, nil
+}
+
+// activateLV activates the logical volume if it is not active yet
+func activateLV(ctx context.Context, vg string, lv *LogicalVolume) (string, error) {
+	if lv.isActive() {
+		return "", nil
+	}
+	args := []string{"-ay", fmt.Sprintf("%s/%s", vg, lv.Name)}
+	klog.Infof("lvchange %s", args)
+	out, err := lvmCommand(ctx, "lvchange", args...)
+	return string(out), err
+}
+
+// partitionTableType returns the type of the partition table on the given device, or an empty string if there is none
+func partitionTableType(device string) string {
+	out, err := exec.Command("blkid", "-p", "-o", "value", "-s", "PTTYPE", device).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runImports imports the logical volumes of persistent volumes requested by lvmctl migrate every interval seconds
+func (cs *controllerServer) runImports(interval int) {
+	for {
+		pvs, err := cs.pvs.list()
+		if err != nil {
+			klog.Errorf("unable to list persistent volumes: %v", err)
+		} else {
+			for _, pv := range pvs {
+				if _, ok := pv.Annotations[importAnnotation]; !ok || pv.Spec.CSI == nil {
+					continue
+				}
+				volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+				if err != nil || volID.node != cs.nodeID || volID.vgName != cs.vgName {
+					continue
+				}
+				cs.importVolume(pv, volID.lvName)
+			}
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// importVolume tags the logical volume of the persistent volume as volume of this driver and removes the request annotation
+func (cs *controllerServer) importVolume(pv *v1.PersistentVolume, lvName string) {
+	if err := cs.locks.tryAcquire(lvName, "Import"); err != nil {
+		return
+	}
+	defer cs.locks.release(lvName)
+
+	var err error
+	withNodeSlot(func() {
+		_, _, err = ImportLV(context.Background(), cs.vgName, lvName)
+	})
+	if err != nil {
+		// the request stays and is retried
+		klog.Errorf("unable to import logical volume %s of persistent volume %s: %v", lvName, pv.Name, err)
+		return
+	}
+
+	current, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("unable to read persistent volume %s: %v", pv.Name, err)
+		return
+	}
+	delete(current.Annotations, importAnnotation)
+	_, err = cs.kubeClient.CoreV1().PersistentVolumes().Update(context.Background(), current, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Errorf("unable to update persistent volume %s: %v", pv.Name, err)
+	}
+}
@@ -0,0 +1,169 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	inventoryLabel  = "csi-lvm.metal-stack.io/inventory"
+	inventoryPrefix = "csi-lvm-inventory-"
+	inventoryKey    = "inventory"
+)
+
+// nodeInventory is the lvm state of a node, published by the node plugin running there.
+// The controller can not execute lvm commands on other nodes, it uses the inventories instead.
+type nodeInventory struct {
+	Node string          `json:"node"`
+	VG   *VolumeGroup    `json:"vg,omitempty"`
+	LVs  []LogicalVolume `json:"lvs,omitempty"`
+	// Agent is the address of the agent of the node plugin, empty if disabled
+	Agent   string    `json:"agent,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func inventoryName(node string) string {
+	return inventoryPrefix + node
+}
+
+// runInventory publishes the inventory of this node every interval seconds
+func runInventory(kubeClient kubernetes.Clientset, namespace string, nodeID string, vgName string, agent string, interval int) {
+	for {
+		err := publishInventory(kubeClient, namespace, nodeID, vgName, agent)
+		if err != nil {
+			klog.Errorf("unable to publish lvm inventory of node %s: %v", nodeID, err)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func publishInventory(kubeClient kubernetes.Clientset, namespace string, nodeID string, vgName string, agent string) error {
+	inv := nodeInventory{
+		Node:    nodeID,
+		Agent:   agent,
+		Updated: time.Now(),
+	}
+	// the volume group is created with the first volume, an inventory without it is still valid
+	vgexists, err := vgExists(vgName)
+	if err != nil {
+		return err
+	}
+	if vgexists {
+		vg, err := GetVG(vgName)
+		if err != nil {
+			return err
+		}
+		lvs, err := ListLVs(vgName)
+		if err != nil {
+			return err
+		}
+		inv.VG = vg
+		inv.LVs = lvs
+		updateInventoryMetrics(nodeID, *vg, lvs)
+	}
+
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   inventoryName(nodeID),
+			Labels: map[string]string{inventoryLabel: "true"},
+		},
+		Data: map[string]string{inventoryKey: string(data)},
+	}
+	_, err = kubeClient.CoreV1().ConfigMaps(namespace).Update(context.Background(), cm, metav1.UpdateOptions{})
+	if k8serror.IsNotFound(err) {
+		_, err = kubeClient.CoreV1().ConfigMaps(namespace).Create(context.Background(), cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// listInventories returns the inventories of all nodes, sorted by node name
+func listInventories(kubeClient kubernetes.Clientset, namespace string) ([]nodeInventory, error) {
+	cms, err := kubeClient.CoreV1().ConfigMaps(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: inventoryLabel + "=true"})
+	if err != nil {
+		return nil, err
+	}
+	var invs []nodeInventory
+	for _, cm := range cms.Items {
+		var inv nodeInventory
+		if err := json.Unmarshal([]byte(cm.Data[inventoryKey]), &inv); err != nil {
+			klog.Errorf("ignoring invalid lvm inventory %s: %v", cm.Name, err)
+			continue
+		}
+		invs = append(invs, inv)
+	}
+	sort.Slice(invs, func(i, j int) bool { return invs[i].Node < invs[j].Node })
+	return invs, nil
+}
+
+// getInventory returns the inventory of the given node
+func getInventory(kubeClient kubernetes.Clientset, namespace string, node string) (*nodeInventory, error) {
+	cm, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), inventoryName(node), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var inv nodeInventory
+	if err := json.Unmarshal([]byte(cm.Data[inventoryKey]), &inv); err != nil {
+		return nil, fmt.Errorf("invalid lvm inventory %s: %v", cm.Name, err)
+	}
+	return &inv, nil
+}
+
+// isStale returns true if the node plugin did not publish the inventory for more than three intervals
+func (inv nodeInventory) isStale(interval int) bool {
+	return time.Since(inv.Updated) > 3*time.Duration(interval)*time.Second
+}
+
+// volumes returns the logical volumes of persistent volumes, ephemeral and trashed volumes are skipped
+func (inv nodeInventory) volumes() []LogicalVolume {
+	var lvs []LogicalVolume
+	for _, lv := range inv.LVs {
+		if !lv.hasTag(lvmDriverTag) || strings.HasPrefix(lv.Name, "csi-") || lv.isTrashed() {
+			continue
+		}
+		lvs = append(lvs, lv)
+	}
+	return lvs
+}
+
+// reclaimableBytes returns the size of the trashed logical volumes which are reclaimed if the space is needed
+func (inv nodeInventory) reclaimableBytes() int64 {
+	var size int64
+	for _, lv := range reclaimableLVs(inv.LVs) {
+		size += lv.Size
+	}
+	return size
+}
+
+// findLV returns the logical volume with the given name
+func (inv nodeInventory) findLV(name string) *LogicalVolume {
+	for i := range inv.LVs {
+		if inv.LVs[i].Name == name {
+			return &inv.LVs[i]
+		}
+	}
+	return nil
+}
+
+// NodeLogicalVolumes returns the logical volumes of a node as published by the node plugin running there
+func NodeLogicalVolumes(kubeClient kubernetes.Clientset, namespace string, node string) ([]LogicalVolume, error) {
+	inv, err := getInventory(kubeClient, namespace, node)
+	if err != nil {
+		return nil, err
+	}
+	return inv.LVs, nil
+}
@@ -0,0 +1,193 @@
+package lvm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// claimTagPrefix is followed by <namespace>/<name> of the persistent volume claim the volume was created for
+	claimTagPrefix = "lv.metal-stack.io/csi-lvm-pvc="
+
+	// sectors in /sys/block/<dev>/stat are always 512 bytes
+	sectorSize = 512
+)
+
+var volumeStatsLabels = []string{"node", "volume", "pvc_namespace", "pvc"}
+
+// ClaimTags returns the tags to store the claim of the volume on the logical volume
+func ClaimTags(claim string) []string {
+	if claim == "" {
+		return nil
+	}
+	return []string{claimTagPrefix + claim}
+}
+
+// claimName returns <namespace>/<name> of the claim, empty if there is none
+func claimName(ref *v1.ObjectReference) string {
+	if ref == nil || ref.Name == "" {
+		return ""
+	}
+	return ref.Namespace + "/" + ref.Name
+}
+
+// claim returns namespace and name of the claim the logical volume was created for
+func (lv LogicalVolume) claim() (string, string) {
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, claimTagPrefix) {
+			parts := strings.SplitN(strings.TrimPrefix(tag, claimTagPrefix), "/", 2)
+			if len(parts) == 2 {
+				return parts[0], parts[1]
+			}
+		}
+	}
+	return "", ""
+}
+
+// volumeHandles returns the volume handles of the persistent volumes on this node by logical volume name, the handle of
+// a legacy volume is the plain name of its logical volume
+func volumeHandles(pvs *pvCache, nodeID string, vgName string) map[string]string {
+	handles := map[string]string{}
+	if pvs == nil {
+		return handles
+	}
+	list, err := pvs.list()
+	if err != nil {
+		klog.V(4).Infof("volume handles unknown: %v", err)
+		return handles
+	}
+	for _, pv := range list {
+		if pv.Spec.CSI == nil {
+			continue
+		}
+		volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			continue
+		}
+		if volID.isLegacy() {
+			volID.node = pvNode(pv)
+			volID.vgName = vgName
+		}
+		if volID.node == nodeID && volID.vgName == vgName {
+			handles[volID.lvName] = pv.Spec.CSI.VolumeHandle
+		}
+	}
+	return handles
+}
+
+// volumeLabel returns the volume label of the metrics of a logical volume, which is the handle of its persistent
+// volume, or its volume id if there is none
+func volumeLabel(handles map[string]string, nodeID string, vgName string, lvName string) string {
+	if handle, ok := handles[lvName]; ok {
+		return handle
+	}
+	return volumeID{node: nodeID, vgName: vgName, lvName: lvName}.String()
+}
+
+// volumeStatsCollector exports the i/o statistics of the device mapper devices of the volumes on this node. Rates,
+// e.g. iops, throughput and latency, are calculated by prometheus.
+type volumeStatsCollector struct {
+	nodeID string
+	vgName string
+	pvs    *pvCache
+
+	readOps      *prometheus.Desc
+	writeOps     *prometheus.Desc
+	readBytes    *prometheus.Desc
+	writeBytes   *prometheus.Desc
+	readSeconds  *prometheus.Desc
+	writeSeconds *prometheus.Desc
+	inFlight     *prometheus.Desc
+}
+
+func newVolumeStatsCollector(nodeID string, vgName string, pvs *pvCache) *volumeStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "volume", name), help, volumeStatsLabels, nil)
+	}
+	return &volumeStatsCollector{
+		nodeID:       nodeID,
+		vgName:       vgName,
+		pvs:          pvs,
+		readOps:      desc("read_ops_total", "Completed read operations of the volume."),
+		writeOps:     desc("write_ops_total", "Completed write operations of the volume."),
+		readBytes:    desc("read_bytes_total", "Bytes read from the volume."),
+		writeBytes:   desc("write_bytes_total", "Bytes written to the volume."),
+		readSeconds:  desc("read_time_seconds_total", "Time spent on read operations of the volume, divided by the operations it is the read latency."),
+		writeSeconds: desc("write_time_seconds_total", "Time spent on write operations of the volume, divided by the operations it is the write latency."),
+		inFlight:     desc("io_in_flight", "I/O operations of the volume in progress."),
+	}
+}
+
+func (c *volumeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.readOps
+	ch <- c.writeOps
+	ch <- c.readBytes
+	ch <- c.writeBytes
+	ch <- c.readSeconds
+	ch <- c.writeSeconds
+	ch <- c.inFlight
+}
+
+func (c *volumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	if exists, err := vgExists(c.vgName); err != nil || !exists {
+		return
+	}
+	lvs, err := ListLVs(c.vgName)
+	if err != nil {
+		klog.Errorf("unable to list logical volumes for i/o statistics: %v", err)
+		return
+	}
+	handles := volumeHandles(c.pvs, c.nodeID, c.vgName)
+	for _, lv := range lvs {
+		if !lv.hasTag(lvmDriverTag) || lv.isTrashed() || !lv.isActive() {
+			continue
+		}
+		stat, err := deviceStat(lvPath(c.vgName, lv.Name))
+		if err != nil {
+			klog.V(4).Infof("no i/o statistics of logical volume %s: %v", lv.Name, err)
+			continue
+		}
+		namespace, claim := lv.claim()
+		labels := []string{c.nodeID, volumeLabel(handles, c.nodeID, c.vgName, lv.Name), namespace, claim}
+
+		ch <- prometheus.MustNewConstMetric(c.readOps, prometheus.CounterValue, stat[0], labels...)
+		ch <- prometheus.MustNewConstMetric(c.readBytes, prometheus.CounterValue, stat[2]*sectorSize, labels...)
+		ch <- prometheus.MustNewConstMetric(c.readSeconds, prometheus.CounterValue, stat[3]/1000, labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeOps, prometheus.CounterValue, stat[4], labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeBytes, prometheus.CounterValue, stat[6]*sectorSize, labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeSeconds, prometheus.CounterValue, stat[7]/1000, labels...)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, stat[8], labels...)
+	}
+}
+
+// deviceStat returns the fields of /sys/block/dm-<n>/stat of the device mapper device behind path, see
+// Documentation/block/stat.rst of the kernel
+func deviceStat(path string) ([]float64, error) {
+	device := filepath.Base(devicePath(path))
+	if !strings.HasPrefix(device, "dm-") {
+		return nil, fmt.Errorf("%s is no device mapper device", path)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("/sys/block", device, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("unexpected format of %s statistics: %s", device, data)
+	}
+	stat := make([]float64, len(fields))
+	for i, f := range fields {
+		stat[i], err = strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected format of %s statistics: %s", device, data)
+		}
+	}
+	return stat, nil
+}
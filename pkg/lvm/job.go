@@ -0,0 +1,307 @@
+package lvm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	provisionerActionLabel = "csi-lvm.metal-stack.io/action"
+	provisionerVolumeLabel = "csi-lvm.metal-stack.io/volume"
+	provisionerNodeLabel   = "csi-lvm.metal-stack.io/node"
+	// provisionerArgsAnnotation holds the node and arguments of the provisioner, a job on another node or with other
+	// arguments is not adopted. Arguments of reloadable settings are left out, see adoptionArgs.
+	provisionerArgsAnnotation = "csi-lvm.metal-stack.io/args"
+
+	provisionerJobBackoffLimit = int32(2)
+	// provisionerJobTTL removes finished jobs of a controller which crashed before it could delete them
+	provisionerJobTTL = int32(600)
+
+	maxNameLength = 63
+)
+
+// provisionerJobArgs are stored in the args annotation of a provisioner job
+type provisionerJobArgs struct {
+	Node string   `json:"node"`
+	Args []string `json:"args"`
+}
+
+// reloadableArgs are provisioner flags of settings which can change with a reload of the configuration, a job started
+// before the reload is still adopted
+var reloadableArgs = map[string]bool{"--wipetimeout": true}
+
+// adoptionArgs returns the arguments of the provisioner without the flags of reloadable settings and their values
+func adoptionArgs(args []string) []string {
+	result := []string{}
+	for i := 0; i < len(args); i++ {
+		if reloadableArgs[args[i]] {
+			i++
+			continue
+		}
+		result = append(result, args[i])
+	}
+	return result
+}
+
+// labelValue shortens values exceeding the maximum length of label values and job names
+func labelValue(value string) string {
+	if len(value) <= maxNameLength {
+		return value
+	}
+	hash := sha256.Sum256([]byte(value))
+	return value[:maxNameLength-11] + "-" + hex.EncodeToString(hash[:])[:10]
+}
+
+// startProvisionerJob creates the job. A job left over from a previous attempt or controller instance is adopted if
+// it has the same arguments and did not fail, otherwise it is replaced.
+func startProvisionerJob(ctx context.Context, kubeClient kubernetes.Clientset, namespace string, job *batchv1.Job) error {
+	job.Name = labelValue(job.Name)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("k8s.job.name", job.Name))
+	for {
+		_, err := kubeClient.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
+		if err == nil {
+			span.AddEvent("job created")
+		}
+		if !k8serror.IsAlreadyExists(err) {
+			return err
+		}
+
+		existing, err := kubeClient.BatchV1().Jobs(namespace).Get(ctx, job.Name, metav1.GetOptions{})
+		if k8serror.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if existing.DeletionTimestamp == nil {
+			if existing.Annotations[provisionerArgsAnnotation] == job.Annotations[provisionerArgsAnnotation] && !jobFailed(existing) {
+				klog.Infof("adopting existing provisioner job %s", job.Name)
+				span.AddEvent("job adopted")
+				return nil
+			}
+			klog.Infof("replacing provisioner job %s, args:%s", job.Name, existing.Annotations[provisionerArgsAnnotation])
+			span.AddEvent("job replaced")
+			err = deleteProvisionerJob(kubeClient, namespace, job.Name)
+			if err != nil {
+				return err
+			}
+		}
+		// wait for the garbage collector to remove the old job
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// waitProvisionerJob watches the job until it succeeded or failed and deletes it afterwards. A job which did not
+// finish before ctx is done is kept, it is adopted by the next attempt and stopped by its active deadline otherwise.
+// A canceled request deletes the job.
+func waitProvisionerJob(ctx context.Context, va volumeAction, name string, retrySeconds int) error {
+	jobs := va.kubeClient.BatchV1().Jobs(va.namespace)
+	for {
+		job, err := jobs.Get(ctx, name, metav1.GetOptions{})
+		if k8serror.IsNotFound(err) {
+			klog.Infof("provisioner job %s is already gone", name)
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return abandonProvisionerJob(ctx, va, name, retrySeconds)
+			}
+			klog.Errorf("error reading provisioner job %s:%v", name, err)
+			select {
+			case <-ctx.Done():
+				return abandonProvisionerJob(ctx, va, name, retrySeconds)
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		if done, err := provisionerJobDone(ctx, va, job); done {
+			return err
+		}
+
+		w, err := jobs.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: job.ResourceVersion,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return abandonProvisionerJob(ctx, va, name, retrySeconds)
+			}
+			klog.Errorf("unable to watch provisioner job %s:%v", name, err)
+			select {
+			case <-ctx.Done():
+				return abandonProvisionerJob(ctx, va, name, retrySeconds)
+			case <-time.After(1 * time.Second):
+			}
+			continue
+		}
+		done, err := watchProvisionerJob(ctx, va, w)
+		w.Stop()
+		if done {
+			return err
+		}
+		if ctx.Err() != nil {
+			return abandonProvisionerJob(ctx, va, name, retrySeconds)
+		}
+		// the watch expired, read the job again
+	}
+}
+
+// watchProvisionerJob processes the events of the job until it is done, the watch ends or ctx is done
+func watchProvisionerJob(ctx context.Context, va volumeAction, w watch.Interface) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			switch event.Type {
+			case watch.Deleted:
+				klog.Infof("provisioner job of %s for volume %s is already gone", va.action, va.name)
+				return true, nil
+			case watch.Added, watch.Modified:
+				job, ok := event.Object.(*batchv1.Job)
+				if !ok {
+					continue
+				}
+				if done, err := provisionerJobDone(ctx, va, job); done {
+					return true, err
+				}
+			case watch.Error:
+				return false, nil
+			}
+		}
+	}
+}
+
+// provisionerJobDone returns true and the result of the job if it succeeded or failed, the job is deleted then
+func provisionerJobDone(ctx context.Context, va volumeAction, job *batchv1.Job) (bool, error) {
+	span := trace.SpanFromContext(ctx)
+	if jobFailed(job) {
+		span.AddEvent("job failed")
+		// job terminated in time, but with failure
+		// return ResourceExhausted so the requesting pod can be rescheduled to anonther node
+		// see https://github.com/kubernetes-csi/external-provisioner/pull/405
+		klog.Infof("provisioner job %s terminated with failure", job.Name)
+		// the pods are gone with the job
+		err := provisionerJobError(va, job)
+		if err := deleteProvisionerJob(va.kubeClient, va.namespace, job.Name); err != nil {
+			klog.Errorf("unable to delete the provisioner job %s: %v", job.Name, err)
+		}
+		return true, err
+	}
+	if job.Status.Succeeded > 0 {
+		klog.Infof("provisioner job %s terminated successfully", job.Name)
+		span.AddEvent("job succeeded")
+		if va.action == actionTypeCreateSnapshot {
+			recordProvisionerResult(va, readTerminationResult(terminationMessage(va, job, true)))
+		}
+		if err := deleteProvisionerJob(va.kubeClient, va.namespace, job.Name); err != nil {
+			klog.Errorf("unable to delete the provisioner job %s: %v", job.Name, err)
+		}
+		klog.Infof("%s for volume %s on %v was successful", va.action, va.name, va.nodeName)
+		return true, nil
+	}
+	klog.Infof("provisioner job %s active:%d failed:%d", job.Name, job.Status.Active, job.Status.Failed)
+	span.AddEvent("job status", trace.WithAttributes(attribute.Int("active", int(job.Status.Active)), attribute.Int("failed", int(job.Status.Failed))))
+	return false, nil
+}
+
+// provisionerJobError returns the error the provisioner wrote to the termination log of its last failed pod
+func provisionerJobError(va volumeAction, job *batchv1.Job) error {
+	message := terminationMessage(va, job, false)
+	if pe := readTerminationMessage(message); pe != nil {
+		klog.Errorf("provisioner job %s failed: %v", job.Name, pe)
+		return pe.GRPCStatus().Err()
+	}
+	if message != "" {
+		return status.Errorf(codes.ResourceExhausted, "provisioner job %s terminated with failure: %s", job.Name, strings.TrimSpace(message))
+	}
+	return status.Errorf(codes.ResourceExhausted, "provisioner job %s terminated with failure", job.Name)
+}
+
+// terminationMessage returns the termination message of the last succeeded or failed pod of the job
+func terminationMessage(va volumeAction, job *batchv1.Job, succeeded bool) string {
+	pods, err := va.kubeClient.CoreV1().Pods(va.namespace).List(context.Background(), metav1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		klog.Errorf("unable to list pods of provisioner job %s: %v", job.Name, err)
+		return ""
+	}
+	var message string
+	var finished time.Time
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			terminated := cs.State.Terminated
+			if terminated == nil || (terminated.ExitCode == 0) != succeeded || terminated.Message == "" || terminated.FinishedAt.Time.Before(finished) {
+				continue
+			}
+			message = terminated.Message
+			finished = terminated.FinishedAt.Time
+		}
+	}
+	return message
+}
+
+// abandonProvisionerJob stops waiting for the job, it is deleted if the request was canceled
+func abandonProvisionerJob(ctx context.Context, va volumeAction, name string, retrySeconds int) error {
+	trace.SpanFromContext(ctx).AddEvent("job abandoned")
+	if ctx.Err() == context.Canceled {
+		if err := deleteProvisionerJob(va.kubeClient, va.namespace, name); err != nil {
+			klog.Errorf("unable to delete the provisioner job %s: %v", name, err)
+		}
+	}
+	return contextError(ctx, fmt.Errorf("provisioner job %s did not finish within %d seconds", name, retrySeconds))
+}
+
+// contextError returns err as Aborted if ctx was canceled and as DeadlineExceeded if it timed out
+func contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Errorf(codes.Aborted, "request canceled: %v", err)
+	case context.DeadlineExceeded:
+		return status.Errorf(codes.DeadlineExceeded, "request timed out: %v", err)
+	}
+	return err
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteProvisionerJob deletes the job and its pods
+func deleteProvisionerJob(kubeClient kubernetes.Clientset, namespace string, name string) error {
+	propagation := metav1.DeletePropagationBackground
+	err := kubeClient.BatchV1().Jobs(namespace).Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if k8serror.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package lvm
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks prevents concurrent operations on the same volume. As recommended by the CSI spec a request for a
+// volume with an operation in progress is rejected with Aborted, the caller retries it later.
+type volumeLocks struct {
+	mu sync.Mutex
+	// inFlight maps the volume to the operation in progress
+	inFlight map[string]string
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{inFlight: map[string]string{}}
+}
+
+// tryAcquire locks the volume for the operation, it must be released by the caller if no error is returned
+func (l *volumeLocks) tryAcquire(volume string, operation string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, ok := l.inFlight[volume]; ok {
+		return status.Errorf(codes.Aborted, "an operation %s for volume %s is already in progress", current, volume)
+	}
+	l.inFlight[volume] = operation
+	return nil
+}
+
+func (l *volumeLocks) release(volume string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.inFlight, volume)
+}
+
+// snapshotLockKey separates the locks of snapshots from the locks of volumes
+func snapshotLockKey(snapshot string) string {
+	return "snapshot/" + snapshot
+}
@@ -18,7 +18,9 @@ package lvm
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,11 +28,11 @@ import (
 	"strings"
 	"time"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
-	k8serror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
@@ -48,19 +50,13 @@ const (
 
 // Lvm contains the main parameters
 type Lvm struct {
-	name                        string
-	nodeID                      string
-	version                     string
-	endpoint                    string
-	ephemeral                   bool
-	devicesPattern              string
-	vgName                      string
-	provisionerImage            string
-	pullPolicy                  v1.PullPolicy
-	namespace                   string
-	lvmTimeout                  int
-	snapshotTimeout             int
-	lvmSnapshotBufferPercentage int
+	config      Config
+	version     string
+	agentToken  string
+	agentTLS    *agentTLSConfig
+	podTemplate *v1.PodTemplateSpec
+	// settings of the configuration which are reloaded without restart
+	settings *liveSettings
 
 	ids *identityServer
 	ns  *nodeServer
@@ -86,8 +82,17 @@ type volumeAction struct {
 	namespace                   string
 	vgName                      string
 	snapshotName                string
+	sourceName                  string
+	backend                     string
 	S3Parameter                 S3Parameter
 	lvmSnapshotBufferPercentage int
+	trashRetention              time.Duration
+	wipePolicy                  string
+	wipeTimeout                 int
+	// pvc receives an event if the action fails
+	pvc *v1.ObjectReference
+	// podTemplate of the operator for the provisioner job
+	podTemplate *v1.PodTemplateSpec
 }
 
 const (
@@ -102,96 +107,176 @@ const (
 	pullIfNotPresent          = "ifnotpresent"
 	actionTypeCreateSnapshot  = "createsnapshot"
 	actionTypeRestoreSnapshot = "restoresnapshot"
+	actionTypeClone           = "clone"
+
+	// lvmDriverTag is added to every logical volume created by this driver
+	lvmDriverTag = "lv.metal-stack.io/csi-lvm-driver"
 )
 
-// NewLvmDriver creates the driver
-func NewLvmDriver(driverName, nodeID, endpoint string, ephemeral bool, version string, devicesPattern string, vgName string, namespace string, provisionerImage string, pullPolicy string, lvmTimeout int, snapshotTimeout int, lvmSnapshotBufferPercentage int) (*Lvm, error) {
-	if driverName == "" {
-		return nil, fmt.Errorf("no driver name provided")
-	}
+// LogicalVolume describes a logical volume as reported by lvs
+type LogicalVolume struct {
+	Name         string    `json:"name"`
+	VGName       string    `json:"vgname"`
+	Size         int64     `json:"size"`
+	Attr         string    `json:"attr"`
+	Tags         []string  `json:"tags,omitempty"`
+	Origin       string    `json:"origin,omitempty"`
+	PoolLV       string    `json:"poollv,omitempty"`
+	HealthStatus string    `json:"healthstatus,omitempty"`
+	CreationTime time.Time `json:"creationtime"`
+}
 
-	if nodeID == "" {
-		return nil, fmt.Errorf("no node id provided")
-	}
+// VolumeGroup describes a volume group as reported by vgs
+type VolumeGroup struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Free    int64  `json:"free"`
+	PVCount int    `json:"pvcount"`
+}
 
-	if endpoint == "" {
-		return nil, fmt.Errorf("no driver endpoint provided")
+// NewLvmDriver creates the driver with the validated configuration
+func NewLvmDriver(config Config, version string) (*Lvm, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 	if version != "" {
 		vendorVersion = version
 	}
+	maxNodeOperations = config.MaxNodeOperations
 
-	pp := v1.PullAlways
-	if strings.ToLower(pullPolicy) == pullIfNotPresent {
+	if config.provisionerPullPolicy() == v1.PullIfNotPresent {
 		klog.Info("pullpolicy: IfNotPresent")
-		pp = v1.PullIfNotPresent
 	}
 
-	klog.Infof("Driver: %v ", driverName)
+	agentToken := ""
+	if config.AgentTokenFile != "" {
+		token, err := ioutil.ReadFile(config.AgentTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read agent token: %v", err)
+		}
+		agentToken = strings.TrimSpace(string(token))
+	}
+	if config.AgentAddress != "" && agentToken == "" {
+		return nil, fmt.Errorf("the agent requires a token")
+	}
+	var agentTLS *agentTLSConfig
+	if config.AgentTLSDir != "" {
+		var err error
+		agentTLS, err = loadAgentTLS(config.AgentTLSDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	podTemplate, err := loadPodTemplate(config.ProvisionerPodTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Driver: %v ", config.DriverName)
 	klog.Infof("Version: %s", vendorVersion)
 
 	return &Lvm{
-		name:                        driverName,
-		version:                     vendorVersion,
-		nodeID:                      nodeID,
-		endpoint:                    endpoint,
-		ephemeral:                   ephemeral,
-		devicesPattern:              devicesPattern,
-		vgName:                      vgName,
-		namespace:                   namespace,
-		provisionerImage:            provisionerImage,
-		pullPolicy:                  pp,
-		lvmTimeout:                  lvmTimeout,
-		snapshotTimeout:             snapshotTimeout,
-		lvmSnapshotBufferPercentage: lvmSnapshotBufferPercentage,
+		config:      config,
+		version:     vendorVersion,
+		agentToken:  agentToken,
+		agentTLS:    agentTLS,
+		podTemplate: podTemplate,
+		settings:    newLiveSettings(config.Settings),
 	}, nil
 }
 
 // Run starts the lvm plugin
 func (lvm *Lvm) Run() {
+	c := lvm.config
 	// Create GRPC servers
-	lvm.ids = newIdentityServer(lvm.name, lvm.version)
-	lvm.ns = newNodeServer(lvm.nodeID, lvm.ephemeral, lvm.devicesPattern, lvm.vgName)
-	lvm.cs = newControllerServer(lvm.ephemeral, lvm.nodeID, lvm.devicesPattern, lvm.vgName, lvm.namespace, lvm.provisionerImage, lvm.pullPolicy, lvm.lvmTimeout, lvm.snapshotTimeout, lvm.lvmSnapshotBufferPercentage)
+	lvm.ns = newNodeServer(c.NodeID, c.Ephemeral, c.DevicesPattern, c.VGName)
+	lvm.cs = newControllerServer(c, lvm.settings, lvm.agentToken, lvm.agentTLS, lvm.podTemplate)
+
+	// the startup report shows what is missing before the first probe fails
+	var kubeClient kubernetes.Interface
+	if !c.Ephemeral {
+		kubeClient = &lvm.cs.kubeClient
+	}
+	check := newSelfCheck(c.VGName, c.DevicesPattern, c.AgentAddress != "", kubeClient)
+	check.run()
+	if c.LivenessAddress != "" {
+		go check.serveLiveness(c.LivenessAddress)
+	}
+	lvm.ids = newIdentityServer(c.DriverName, lvm.version, check)
+
+	if !c.Ephemeral {
+		// the node server must not wait for the kubernetes api, the loops skip their runs until the cache is synced
+		go lvm.cs.pvs.start()
+		// volumes deleted while this node was away must be gone before any of them is published again
+		if err := processPendingDeletions(lvm.cs.kubeClient, c.Namespace, c.NodeID, c.TrashRetention.Duration); err != nil {
+			klog.Errorf("unable to process pending deletions of node %s: %v", c.NodeID, err)
+		}
+		go runPendingDeletions(lvm.cs.kubeClient, c.Namespace, c.NodeID, c.InventoryInterval, c.TrashRetention.Duration)
+		go lvm.cs.runTrash(c.InventoryInterval, c.TrashRetention.Duration)
+		// the agent is only advertised if it is served
+		agentAdvertiseAddress := ""
+		if c.AgentAddress != "" {
+			agentAdvertiseAddress = c.AgentAdvertiseAddress
+		}
+		go runInventory(lvm.cs.kubeClient, c.Namespace, c.NodeID, c.VGName, agentAdvertiseAddress, c.InventoryInterval)
+		go lvm.cs.runRollbacks(c.InventoryInterval)
+		go lvm.cs.runImports(c.InventoryInterval)
+		if c.OrphanInterval > 0 {
+			go newOrphanCollector(lvm.cs.kubeClient, lvm.cs.pvs, c.DriverName, c.NodeID, c.VGName, c.OrphanInterval, c.OrphanGracePeriod.Duration, c.OrphanDelete, c.TrashRetention.Duration).run()
+		}
+	}
+	if c.AgentAddress != "" {
+		go serveAgent(c.AgentAddress, c.NodeID, c.VGName, c.DevicesPattern, lvm.agentToken, lvm.agentTLS.server)
+	}
+	go newTrimmer(c.NodeID, c.VGName, lvm.cs.pvs, c.TrimInterval.Duration).run()
+	if c.MetricsAddress != "" {
+		prometheus.MustRegister(newVolumeStatsCollector(c.NodeID, c.VGName, lvm.cs.pvs))
+		go serveMetrics(c.MetricsAddress)
+	}
 
 	s := newNonBlockingGRPCServer()
-	s.start(lvm.endpoint, lvm.ids, lvm.cs, lvm.ns)
+	s.start(c.Endpoint, lvm.ids, lvm.cs, lvm.ns)
 	s.wait()
 }
 
-func mountLV(lvname, mountPath string, vgName string) (string, error) {
+// mountLV mounts the filesystem of the logical volume, a volume without filesystem is formatted with fsType (ext4 if empty).
+// An existing filesystem is never formatted, imported volumes keep their filesystem.
+func mountLV(ctx context.Context, lvname, mountPath string, vgName string, fsType string, mountFlags []string) (string, error) {
 	lvPath := fmt.Sprintf("/dev/%s/%s", vgName, lvname)
 
-	formatted := false
 	// check for already formatted
-	cmd := exec.Command("blkid", lvPath)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		klog.Infof("unable to check if %s is already formatted:%v", lvPath, err)
-	}
-	if strings.Contains(string(out), "ext4") {
-		formatted = true
-	}
-
-	if !formatted {
-		klog.Infof("formatting with mkfs.ext4 %s", lvPath)
-		cmd = exec.Command("mkfs.ext4", lvPath)
-		out, err = cmd.CombinedOutput()
+	formatted := blkidFSType(lvPath)
+	if formatted == "" {
+		if pt := partitionTableType(lvPath); pt != "" {
+			return "", fmt.Errorf("lv:%s contains a %s partition table, refusing to format it", lvname, pt)
+		}
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		klog.Infof("formatting with mkfs.%s %s", fsType, lvPath)
+		out, err := runCommand(ctx, exec.Command("mkfs."+fsType, lvPath))
 		if err != nil {
 			return string(out), fmt.Errorf("unable to format lv:%s err:%v", lvname, err)
 		}
+		formatted = fsType
+	} else if fsType != "" && fsType != formatted {
+		klog.Warningf("lv:%s is formatted with %s instead of requested %s, keeping existing filesystem", lvname, formatted, fsType)
 	}
 
-	err = os.MkdirAll(mountPath, 0777)
+	err := os.MkdirAll(mountPath, 0777)
 	if err != nil {
-		return string(out), fmt.Errorf("unable to create mount directory for lv:%s err:%v", lvname, err)
+		return "", fmt.Errorf("unable to create mount directory for lv:%s err:%v", lvname, err)
 	}
 
 	// --make-shared is required that this mount is visible outside this container.
-	mountArgs := []string{"--make-shared", "-t", "ext4", lvPath, mountPath}
+	mountArgs := []string{"--make-shared", "-t", formatted}
+	if len(mountFlags) > 0 {
+		mountArgs = append(mountArgs, "-o", strings.Join(mountFlags, ","))
+	}
+	mountArgs = append(mountArgs, lvPath, mountPath)
 	klog.Infof("mountlv command: mount %s", mountArgs)
-	cmd = exec.Command("mount", mountArgs...)
-	out, err = cmd.CombinedOutput()
+	out, err := runCommand(ctx, exec.Command("mount", mountArgs...))
 	if err != nil {
 		mountOutput := string(out)
 		if !strings.Contains(mountOutput, "already mounted") {
@@ -206,7 +291,7 @@ func mountLV(lvname, mountPath string, vgName string) (string, error) {
 	return "", nil
 }
 
-func bindMountLV(lvname, mountPath string, vgName string) (string, error) {
+func bindMountLV(ctx context.Context, lvname, mountPath string, vgName string) (string, error) {
 	lvPath := fmt.Sprintf("/dev/%s/%s", vgName, lvname)
 	_, err := os.Create(mountPath)
 	if err != nil {
@@ -217,8 +302,7 @@ func bindMountLV(lvname, mountPath string, vgName string) (string, error) {
 	// --bind is required for raw block volumes to make them visible inside the pod.
 	mountArgs := []string{"--make-shared", "--bind", lvPath, mountPath}
 	klog.Infof("bindmountlv command: mount %s", mountArgs)
-	cmd := exec.Command("mount", mountArgs...)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, exec.Command("mount", mountArgs...))
 	if err != nil {
 		mountOutput := string(out)
 		if !strings.Contains(mountOutput, "already mounted") {
@@ -233,143 +317,218 @@ func bindMountLV(lvname, mountPath string, vgName string) (string, error) {
 	return "", nil
 }
 
-func umountLV(targetPath string) (string, error) {
+func umountLV(ctx context.Context, targetPath string) (string, error) {
 
-	cmd := exec.Command("umount", "--lazy", "--force", targetPath)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, exec.Command("umount", "--lazy", "--force", targetPath))
 	if err != nil {
 		klog.Errorf("unable to umount %s output:%s err:%v", targetPath, string(out), err)
 	}
 	return "", nil
 }
 
-func createProvisionerPod(va volumeAction, retrySeconds int) (err error) {
+// provisionerArgs returns the arguments of the provisioner command for the volume action
+func provisionerArgs(va volumeAction) ([]string, error) {
 	if va.name == "" || va.nodeName == "" {
-		return fmt.Errorf("invalid empty name or path or node")
+		return nil, fmt.Errorf("invalid empty name or path or node")
 	}
 	if va.action == actionTypeCreate && va.lvmType == "" {
-		return fmt.Errorf("createlv without lvm type")
+		return nil, fmt.Errorf("createlv without lvm type")
+	}
+	if va.action == actionTypeClone && (va.lvmType == "" || va.sourceName == "") {
+		return nil, fmt.Errorf("clonelv without lvm type or source")
+	}
+	if va.action == actionTypeRollback && va.snapshotName == "" {
+		return nil, fmt.Errorf("rollbacklv without snapshot")
 	}
 
 	args := []string{}
 	if va.action == actionTypeCreate {
 		args = append(args, "createlv", "--lvsize", fmt.Sprintf("%d", va.size), "--devices", va.devicesPattern, "--lvmtype", va.lvmType)
+		if va.wipePolicy != "" {
+			args = append(args, "--wipepolicy", va.wipePolicy)
+		}
+		if claim := claimName(va.pvc); claim != "" {
+			args = append(args, "--pvc", claim)
+		}
 	}
 	if va.action == actionTypeDelete {
 		args = append(args, "deletelv")
+		if va.trashRetention > 0 {
+			args = append(args, "--trashretention", va.trashRetention.String())
+		}
+		if va.wipeTimeout > 0 {
+			args = append(args, "--wipetimeout", (time.Duration(va.wipeTimeout) * time.Second).String())
+		}
 	}
-	if va.action == actionTypeCreateSnapshot {
+	if va.action == actionTypeCreateSnapshot && va.backend == snapshotBackendLocal {
+		args = append(args, "createsnapshot", "--snapshotname", va.snapshotName, "--backend", va.backend, "--lvmsnapshotbufferpercentage", fmt.Sprintf("%d", va.lvmSnapshotBufferPercentage))
+	} else if va.action == actionTypeCreateSnapshot {
 		args = append(args, "createsnapshot", "--snapshotname", va.snapshotName, "--s3parameter", EncodeS3Parameter(va.S3Parameter), "--lvsize", fmt.Sprintf("%d", va.size), "--lvmsnapshotbufferpercentage", fmt.Sprintf("%d", va.lvmSnapshotBufferPercentage))
 	}
 	if va.action == actionTypeRestoreSnapshot {
 		args = append(args, "restoresnapshot", "--snapshotname", va.snapshotName, "--s3parameter", EncodeS3Parameter(va.S3Parameter))
 	}
+	if va.action == actionTypeRollback {
+		args = append(args, "rollbacklv", "--snapshotname", va.snapshotName)
+	}
+	if va.action == actionTypeClone {
+		args = append(args, "clonelv", "--sourcelvname", va.sourceName, "--lvsize", fmt.Sprintf("%d", va.size), "--lvmtype", va.lvmType, "--lvmsnapshotbufferpercentage", fmt.Sprintf("%d", va.lvmSnapshotBufferPercentage))
+		if va.wipePolicy != "" {
+			args = append(args, "--wipepolicy", va.wipePolicy)
+		}
+		if claim := claimName(va.pvc); claim != "" {
+			args = append(args, "--pvc", claim)
+		}
+	}
 
 	args = append(args, "--lvname", va.name, "--vgname", va.vgName)
+	return args, nil
+}
 
-	klog.Infof("start provisionerPod with args:%s", args)
+func createProvisionerJob(ctx context.Context, va volumeAction, retrySeconds int) (err error) {
+	ctx, span := tracer().Start(ctx, "provisioner job "+string(va.action), trace.WithAttributes(attribute.String("csi.volume", va.name), attribute.String("k8s.node.name", va.nodeName)))
+	defer func() {
+		setSpanError(span, err)
+		span.End()
+	}()
+
+	args, err := provisionerArgs(va)
+	if err != nil {
+		return err
+	}
+	encodedArgs, err := json.Marshal(provisionerJobArgs{Node: va.nodeName, Args: adoptionArgs(args)})
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("start provisioner job with args:%s", args)
 	hostPathType := v1.HostPathDirectoryOrCreate
 	privileged := true
 	mountPropagationBidirectional := v1.MountPropagationBidirectional
-	provisionerPod := &v1.Pod{
+	backoffLimit := provisionerJobBackoffLimit
+	ttl := provisionerJobTTL
+	deadline := int64(retrySeconds)
+	labels := map[string]string{
+		provisionerActionLabel: string(va.action),
+		provisionerVolumeLabel: labelValue(va.name),
+		provisionerNodeLabel:   labelValue(va.nodeName),
+	}
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: string(va.action) + "-" + va.name,
+			Name:        string(va.action) + "-" + va.name,
+			Labels:      labels,
+			Annotations: map[string]string{provisionerArgsAnnotation: string(encodedArgs)},
 		},
-		Spec: v1.PodSpec{
-			RestartPolicy: v1.RestartPolicyNever,
-			NodeName:      va.nodeName,
-			Tolerations: []v1.Toleration{
-				{
-					Operator: v1.TolerationOpExists,
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			// a job which is not adopted in time is stopped
+			ActiveDeadlineSeconds: &deadline,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
 				},
-			},
-			Containers: []v1.Container{
-				{
-					Name:    "csi-lvmplugin-" + string(va.action),
-					Image:   va.provisionerImage,
-					Command: []string{"/csi-lvmplugin-provisioner"},
-					Args:    args,
-					VolumeMounts: []v1.VolumeMount{
+				Spec: v1.PodSpec{
+					RestartPolicy: v1.RestartPolicyNever,
+					NodeName:      va.nodeName,
+					Tolerations: []v1.Toleration{
 						{
-							Name:             "devices",
-							ReadOnly:         false,
-							MountPath:        "/dev",
-							MountPropagation: &mountPropagationBidirectional,
+							Operator: v1.TolerationOpExists,
 						},
+					},
+					Containers: []v1.Container{
 						{
-							Name:      "modules",
-							ReadOnly:  false,
-							MountPath: "/lib/modules",
+							Name:    "csi-lvmplugin-" + string(va.action),
+							Image:   va.provisionerImage,
+							Command: []string{"/csi-lvmplugin-provisioner"},
+							Args:    args,
+							// continues the trace in the provisioner, the job is adopted regardless of it
+							Env: append(traceEnv(ctx), v1.EnvVar{Name: MaxNodeOperationsEnv, Value: strconv.Itoa(maxNodeOperations)}),
+							VolumeMounts: []v1.VolumeMount{
+								{
+									Name:             "devices",
+									ReadOnly:         false,
+									MountPath:        "/dev",
+									MountPropagation: &mountPropagationBidirectional,
+								},
+								{
+									Name:      "modules",
+									ReadOnly:  false,
+									MountPath: "/lib/modules",
+								},
+								{
+									Name:             "lvmbackup",
+									ReadOnly:         false,
+									MountPath:        "/etc/lvm/backup",
+									MountPropagation: &mountPropagationBidirectional,
+								},
+								{
+									Name:             "lvmcache",
+									ReadOnly:         false,
+									MountPath:        "/etc/lvm/cache",
+									MountPropagation: &mountPropagationBidirectional,
+								},
+								{
+									Name:             "lvmlock",
+									ReadOnly:         false,
+									MountPath:        "/run/lock/lvm",
+									MountPropagation: &mountPropagationBidirectional,
+								},
+							},
+							TerminationMessagePath: TerminationLogPath,
+							// the log tail is reported if the provisioner crashed before writing the error
+							TerminationMessagePolicy: v1.TerminationMessageFallbackToLogsOnError,
+							ImagePullPolicy:          va.pullPolicy,
+							SecurityContext: &v1.SecurityContext{
+								Privileged: &privileged,
+							},
 						},
+					},
+					Volumes: []v1.Volume{
 						{
-							Name:             "lvmbackup",
-							ReadOnly:         false,
-							MountPath:        "/etc/lvm/backup",
-							MountPropagation: &mountPropagationBidirectional,
+							Name: "devices",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: "/dev",
+									Type: &hostPathType,
+								},
+							},
 						},
 						{
-							Name:             "lvmcache",
-							ReadOnly:         false,
-							MountPath:        "/etc/lvm/cache",
-							MountPropagation: &mountPropagationBidirectional,
+							Name: "modules",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: "/lib/modules",
+									Type: &hostPathType,
+								},
+							},
 						},
 						{
-							Name:             "lvmlock",
-							ReadOnly:         false,
-							MountPath:        "/run/lock/lvm",
-							MountPropagation: &mountPropagationBidirectional,
+							Name: "lvmbackup",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: "/etc/lvm/backup",
+									Type: &hostPathType,
+								},
+							},
 						},
-					},
-					TerminationMessagePath: "/termination.log",
-					ImagePullPolicy:        va.pullPolicy,
-					SecurityContext: &v1.SecurityContext{
-						Privileged: &privileged,
-					},
-				},
-			},
-			Volumes: []v1.Volume{
-				{
-					Name: "devices",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/dev",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "modules",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/lib/modules",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "lvmbackup",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/etc/lvm/backup",
-							Type: &hostPathType,
-						},
-					},
-				},
-				{
-					Name: "lvmcache",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/etc/lvm/cache",
-							Type: &hostPathType,
+						{
+							Name: "lvmcache",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: "/etc/lvm/cache",
+									Type: &hostPathType,
+								},
+							},
 						},
-					},
-				},
-				{
-					Name: "lvmlock",
-					VolumeSource: v1.VolumeSource{
-						HostPath: &v1.HostPathVolumeSource{
-							Path: "/run/lock/lvm",
-							Type: &hostPathType,
+						{
+							Name: "lvmlock",
+							VolumeSource: v1.VolumeSource{
+								HostPath: &v1.HostPathVolumeSource{
+									Path: "/run/lock/lvm",
+									Type: &hostPathType,
+								},
+							},
 						},
 					},
 				},
@@ -377,74 +536,39 @@ func createProvisionerPod(va volumeAction, retrySeconds int) (err error) {
 		},
 	}
 
-	// If it already exists due to some previous errors, the pod will be cleaned up later automatically
-	// https://github.com/rancher/local-path-provisioner/issues/27
-	_, err = va.kubeClient.CoreV1().Pods(va.namespace).Create(context.Background(), provisionerPod, metav1.CreateOptions{})
-	if err != nil && !k8serror.IsAlreadyExists(err) {
-		return err
-	}
-
-	completed := false
-	reason := fmt.Errorf("create process %s timeout after %v seconds", provisionerPod.Name, retrySeconds)
-	for i := 0; i < retrySeconds; i++ {
-		time.Sleep(1 * time.Second)
-		pod, err := va.kubeClient.CoreV1().Pods(va.namespace).Get(context.Background(), provisionerPod.Name, metav1.GetOptions{})
-		if pod.Status.Phase == v1.PodFailed {
-			// pod terminated in time, but with failure
-			// return ResourceExhausted so the requesting pod can be rescheduled to anonther node
-			// see https://github.com/kubernetes-csi/external-provisioner/pull/405
-			klog.Infof("provisioner pod %s terminated with failure", provisionerPod.Name)
-			reason = status.Errorf(codes.ResourceExhausted, "provisioner pod %s terminated with failure", provisionerPod.Name)
-			break
-		}
-		if err != nil {
-			if k8serror.IsNotFound(err) {
-				klog.Infof("provisioner pod %s is already gone", provisionerPod.Name)
-				return nil
-			}
-			klog.Errorf("error reading provisioner pod %s:%v", provisionerPod.Name, err)
-		} else if pod.Status.Phase == v1.PodSucceeded {
-			klog.Infof("provisioner pod %s terminated successfully", provisionerPod.Name)
-			completed = true
-			break
-		}
-		klog.Infof("provisioner pod %s status:%s", provisionerPod.Name, pod.Status.Phase)
-	}
-
-	e := va.kubeClient.CoreV1().Pods(va.namespace).Delete(context.Background(), provisionerPod.Name, metav1.DeleteOptions{})
-	if e != nil {
-		klog.Errorf("unable to delete the provisioner pod %s: %v", provisionerPod.Name, e)
-	}
+	job.Spec.Template = mergePodTemplate(job.Spec.Template, va.podTemplate)
 
-	if !completed {
-		return reason
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(retrySeconds)*time.Second)
+	defer cancel()
+	err = startProvisionerJob(ctx, va.kubeClient, va.namespace, job)
+	if err != nil {
+		return contextError(ctx, err)
 	}
-
-	klog.Infof("%s for volume %s on %v was successful", va.action, va.name, va.nodeName)
-	return nil
+	return waitProvisionerJob(ctx, va, job.Name, retrySeconds)
 }
 
 // VgExists checks if the given volume group exists
-func vgExists(vgname string) bool {
-	cmd := exec.Command("vgs", vgname, "--noheadings", "-o", "vg_name")
-	out, err := cmd.CombinedOutput()
+// vgExists returns true if the volume group exists, an error is returned if vgs failed for another reason than a
+// missing volume group, e.g. on the lvm lock
+func vgExists(vgname string) (bool, error) {
+	out, err := lvmQuery("vgs", vgname, "--noheadings", "-o", "vg_name")
 	if err != nil {
-		klog.Infof("unable to list existing volumegroups:%v", err)
-		return false
+		if lvmNotFoundPattern.Match(out) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to list volume group %s: %v output:%s", vgname, err, out)
 	}
-	return vgname == strings.TrimSpace(string(out))
+	return vgname == strings.TrimSpace(string(out)), nil
 }
 
 // VgActivate execute vgchange -ay to activate all volumes of the volume group
-func vgActivate(name string) {
+func vgActivate(ctx context.Context, name string) {
 	// scan for vgs and activate if any
-	cmd := exec.Command("vgscan")
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, exec.Command("vgscan"))
 	if err != nil {
 		klog.Infof("unable to scan for volumegroups:%s %v", out, err)
 	}
-	cmd = exec.Command("vgchange", "-ay")
-	_, err = cmd.CombinedOutput()
+	_, err = runCommand(ctx, exec.Command("vgchange", "-ay"))
 	if err != nil {
 		klog.Infof("unable to activate volumegroups:%s %v", out, err)
 	}
@@ -464,20 +588,26 @@ func devices(devicesPattern []string) (devices []string, err error) {
 }
 
 // CreateVG creates a volume group matching the given device patterns
-func CreateVG(name string, devicesPattern string) (string, error) {
+func CreateVG(ctx context.Context, name string, devicesPattern string) (string, error) {
 	dp := strings.Split(devicesPattern, ",")
 	if len(dp) == 0 {
 		return name, fmt.Errorf("invalid empty flag %v", dp)
 	}
 
-	vgexists := vgExists(name)
+	vgexists, err := vgExists(name)
+	if err != nil {
+		return "", err
+	}
 	if vgexists {
 		klog.Infof("volumegroup: %s already exists\n", name)
 		return name, nil
 	}
-	vgActivate(name)
+	vgActivate(ctx, name)
 	// now check again for existing vg again
-	vgexists = vgExists(name)
+	vgexists, err = vgExists(name)
+	if err != nil {
+		return "", err
+	}
 	if vgexists {
 		klog.Infof("volumegroup: %s already exists\n", name)
 		return name, nil
@@ -495,16 +625,19 @@ func CreateVG(name string, devicesPattern string) (string, error) {
 		args = append(args, "--add-tag", tag)
 	}
 	klog.Infof("create vg with command: vgcreate %v", args)
-	cmd := exec.Command("vgcreate", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "vgcreate", args...)
 	return string(out), err
 }
 
 // CreateLVS creates the new volume
 // used by lvcreate provisioner pod and by nodeserver for ephemeral volumes
-func CreateLVS(ctx context.Context, vg string, name string, size uint64, lvmType string) (string, error) {
+func CreateLVS(ctx context.Context, vg string, name string, size uint64, lvmType string, extraTags ...string) (string, error) {
 
-	if lvExists(vg, name) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
 		klog.Infof("logicalvolume: %s already exists\n", name)
 		return name, nil
 	}
@@ -541,30 +674,36 @@ func CreateLVS(ctx context.Context, vg string, name string, size uint64, lvmType
 		return "", fmt.Errorf("unsupported lvmtype: %s", lvmType)
 	}
 
-	tags := []string{"lv.metal-stack.io/csi-lvm-driver"}
+	tags := append([]string{lvmDriverTag}, extraTags...)
 	for _, tag := range tags {
 		args = append(args, "--add-tag", tag)
 	}
 	args = append(args, vg)
 	klog.Infof("lvcreate %s", args)
-	cmd := exec.Command("lvcreate", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvcreate", args...)
 	return string(out), err
 }
 
-func lvExists(vg string, name string) bool {
-	cmd := exec.Command("lvs", vg+"/"+name, "--noheadings", "-o", "lv_name")
-	out, err := cmd.CombinedOutput()
+// lvExists returns true if the logical volume exists, an error is returned if lvs failed for another reason than a
+// missing volume, e.g. on the lvm lock
+func lvExists(vg string, name string) (bool, error) {
+	out, err := lvmQuery("lvs", vg+"/"+name, "--noheadings", "-o", "lv_name")
 	if err != nil {
-		klog.Infof("unable to list existing volumes:%v", err)
-		return false
+		if lvmNotFoundPattern.Match(out) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to list logical volume %s: %v output:%s", name, err, out)
 	}
-	return name == strings.TrimSpace(string(out))
+	return name == strings.TrimSpace(string(out)), nil
 }
 
 func extendLVS(ctx context.Context, vg string, name string, size uint64, isBlock bool) (string, error) {
 
-	if !lvExists(vg, name) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
 		return "", fmt.Errorf("logical volume %s does not exist", name)
 	}
 
@@ -578,29 +717,37 @@ func extendLVS(ctx context.Context, vg string, name string, size uint64, isBlock
 	}
 	args = append(args, fmt.Sprintf("%s/%s", vg, name))
 	klog.Infof("lvextend %s", args)
-	cmd := exec.Command("lvextend", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvextend", args...)
 	return string(out), err
 }
 
-// RemoveLVS executes lvremove
+// RemoveLVS executes lvremove, the volume is wiped before according to its wipe policy
 func RemoveLVS(ctx context.Context, vg string, name string) (string, error) {
 
-	if !lvExists(vg, name) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
 		// volume not found. Has already been deleted or
 		return fmt.Sprintf("logical volume %s not found in volumegroup %s.", name, vg), nil
 	}
+	lv, err := getLV(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if err := wipeLV(ctx, vg, lv); err != nil {
+		return "", err
+	}
 	args := []string{"-q", "-y"}
 	args = append(args, fmt.Sprintf("%s/%s", vg, name))
 	klog.Infof("lvremove %s", args)
-	cmd := exec.Command("lvremove", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvremove", args...)
 	return string(out), err
 }
 
 func pvCount(vgname string) (int, error) {
-	cmd := exec.Command("vgs", vgname, "--noheadings", "-o", "pv_count")
-	out, err := cmd.CombinedOutput()
+	out, err := lvmQuery("vgs", vgname, "--noheadings", "-o", "pv_count")
 	if err != nil {
 		return 0, err
 	}
@@ -612,15 +759,169 @@ func pvCount(vgname string) (int, error) {
 	return count, nil
 }
 
+// lvTimeFormat is the default report/time_format of lvm
+const lvTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// lvmReport is the json output of lvs and vgs with --reportformat json
+type lvmReport struct {
+	Report []struct {
+		LV []map[string]string `json:"lv"`
+		VG []map[string]string `json:"vg"`
+	} `json:"report"`
+}
+
+func execLVMReport(command string, args ...string) (*lvmReport, error) {
+	args = append([]string{"--reportformat", "json", "--units", "b", "--nosuffix"}, args...)
+	cmd := exec.Command(command, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute %s %s: %v", command, args, err)
+	}
+	var report lvmReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, fmt.Errorf("unable to parse output of %s: %v", command, err)
+	}
+	return &report, nil
+}
+
+// ListLVs returns all logical volumes of the given volume group
+func ListLVs(vg string) ([]LogicalVolume, error) {
+	report, err := execLVMReport("lvs", "-o", "lv_name,vg_name,lv_size,lv_attr,lv_tags,origin,pool_lv,lv_health_status,lv_time", vg)
+	if err != nil {
+		return nil, err
+	}
+	var lvs []LogicalVolume
+	for _, r := range report.Report {
+		for _, l := range r.LV {
+			size, err := strconv.ParseInt(l["lv_size"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse size of lv %s: %v", l["lv_name"], err)
+			}
+			lv := LogicalVolume{
+				Name:         l["lv_name"],
+				VGName:       l["vg_name"],
+				Size:         size,
+				Attr:         l["lv_attr"],
+				Origin:       l["origin"],
+				PoolLV:       l["pool_lv"],
+				HealthStatus: l["lv_health_status"],
+			}
+			if l["lv_tags"] != "" {
+				lv.Tags = strings.Split(l["lv_tags"], ",")
+			}
+			if t, err := time.Parse(lvTimeFormat, l["lv_time"]); err == nil {
+				lv.CreationTime = t
+			}
+			lvs = append(lvs, lv)
+		}
+	}
+	return lvs, nil
+}
+
+// GetVG returns size, free space and pv count of the given volume group
+func GetVG(vg string) (*VolumeGroup, error) {
+	report, err := execLVMReport("vgs", "-o", "vg_name,vg_size,vg_free,pv_count", vg)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range report.Report {
+		for _, v := range r.VG {
+			size, err := strconv.ParseInt(v["vg_size"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse size of vg %s: %v", vg, err)
+			}
+			free, err := strconv.ParseInt(v["vg_free"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse free space of vg %s: %v", vg, err)
+			}
+			pvs, err := strconv.Atoi(v["pv_count"])
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse pv count of vg %s: %v", vg, err)
+			}
+			return &VolumeGroup{Name: v["vg_name"], Size: size, Free: free, PVCount: pvs}, nil
+		}
+	}
+	return nil, fmt.Errorf("volume group %s not found", vg)
+}
+
+// getLV returns the logical volume with the given name
+func getLV(vg string, name string) (*LogicalVolume, error) {
+	lvs, err := ListLVs(vg + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if len(lvs) != 1 {
+		return nil, fmt.Errorf("logical volume %s not found in volume group %s", name, vg)
+	}
+	return &lvs[0], nil
+}
+
+// hasTag returns true if the logical volume carries the given tag
+func (lv LogicalVolume) hasTag(tag string) bool {
+	for _, t := range lv.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// isThin returns true for thin provisioned volumes, which can be snapshotted without reserving space
+func (lv LogicalVolume) isThin() bool {
+	return len(lv.Attr) > 0 && lv.Attr[0] == 'V'
+}
+
+// isThinPool returns true for thin pools
+func (lv LogicalVolume) isThinPool() bool {
+	return len(lv.Attr) > 0 && lv.Attr[0] == 't'
+}
+
+// isSnapshot returns true for (non thin) copy on write snapshots
+func (lv LogicalVolume) isSnapshot() bool {
+	return len(lv.Attr) > 0 && (lv.Attr[0] == 's' || lv.Attr[0] == 'S')
+}
+
+// isInvalid returns true for snapshots which ran out of space
+func (lv LogicalVolume) isInvalid() bool {
+	return len(lv.Attr) > 4 && lv.Attr[4] == 'I'
+}
+
+// isActive returns true if the logical volume is active, see lv_attr in lvs(8)
+func (lv LogicalVolume) isActive() bool {
+	return len(lv.Attr) > 4 && lv.Attr[4] == 'a'
+}
+
+// isOpen returns true if the device of the logical volume is in use
+func (lv LogicalVolume) isOpen() bool {
+	return len(lv.Attr) > 5 && lv.Attr[5] == 'o'
+}
+
+// isMerging returns true for the origin and the snapshot of a running snapshot merge
+func (lv LogicalVolume) isMerging() bool {
+	return len(lv.Attr) > 0 && (lv.Attr[0] == 'O' || lv.Attr[0] == 'S')
+}
+
 // CreateLVMSnapshot creates a lvm snapshot of a given lvm volume
-func CreateLVMSnapshot(vg string, lvname string, snapshotname string, size uint64) (string, error) {
-	if !vgExists(vg) {
+func CreateLVMSnapshot(ctx context.Context, vg string, lvname string, snapshotname string, size uint64) (string, error) {
+	vgexists, err := vgExists(vg)
+	if err != nil {
+		return "", err
+	}
+	if !vgexists {
 		return "", fmt.Errorf("volume group %s does not exist", vg)
 	}
-	if !lvExists(vg, lvname) {
+	exists, err := lvExists(vg, lvname)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
 		return "", fmt.Errorf("logical volume %s does not exist", lvname)
 	}
-	if lvExists(vg, snapshotname) {
+	exists, err = lvExists(vg, snapshotname)
+	if err != nil {
+		return "", err
+	}
+	if exists {
 		return "", fmt.Errorf("logical snapshot volume %s aleardy exists", snapshotname)
 	}
 
@@ -629,16 +930,23 @@ func CreateLVMSnapshot(vg string, lvname string, snapshotname string, size uint6
 	args := []string{"-q", "-s", fmt.Sprintf("%s/%s", vg, lvname), "-n", snapshotname, "-y", "-L", fmt.Sprintf("%ds", int64(float64(size)/512)+10000)}
 
 	klog.Infof("lvcreate %s", args)
-	cmd := exec.Command("lvcreate", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvcreate", args...)
 	return string(out), err
 }
 
-func DeleteLVMSnapshot(vg string, snapshotname string) (string, error) {
-	if !vgExists(vg) {
+func DeleteLVMSnapshot(ctx context.Context, vg string, snapshotname string) (string, error) {
+	vgexists, err := vgExists(vg)
+	if err != nil {
+		return "", err
+	}
+	if !vgexists {
 		return "", fmt.Errorf("volume group %s does not exist", vg)
 	}
-	if !lvExists(vg, snapshotname) {
+	exists, err := lvExists(vg, snapshotname)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
 		return "", fmt.Errorf("logical snapshot volume %s does not exist", snapshotname)
 	}
 
@@ -646,7 +954,6 @@ func DeleteLVMSnapshot(vg string, snapshotname string) (string, error) {
 	args = append(args, fmt.Sprintf("%s/%s", vg, snapshotname))
 	klog.Infof("lvremove %s", args)
 
-	cmd := exec.Command("lvremove", args...)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvremove", args...)
 	return string(out), err
 }
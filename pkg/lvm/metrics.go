@@ -0,0 +1,151 @@
+package lvm
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "csi_lvm"
+
+var (
+	orphanedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_volumes",
+		Help:      "Number of logical volumes of the driver without persistent volume.",
+	}, []string{"node"})
+	orphanedVolumeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_volume_bytes",
+		Help:      "Size of the logical volumes of the driver without persistent volume.",
+	}, []string{"node"})
+	orphanedVolumesDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphaned_volumes_deleted_total",
+		Help:      "Number of orphaned logical volumes deleted by the garbage collector.",
+	}, []string{"node"})
+	pendingDeletions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_deletions",
+		Help:      "Number of volumes deleted while their node was not ready, which are removed when the node is back.",
+	}, []string{"node"})
+	trimmedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trimmed_bytes_total",
+		Help:      "Bytes released by fstrim of mounted filesystem volumes.",
+	}, []string{"node", "volume"})
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Duration of the CSI calls by method and grpc code.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"method", "code"})
+	volumeActionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_action_duration_seconds",
+		Help:      "Duration of the lvm operations executed by provisioner jobs or agents by action and grpc code.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"action", "code"})
+	vgSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vg_size_bytes",
+		Help:      "Size of the volume group.",
+	}, []string{"node", "vg"})
+	vgFreeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vg_free_bytes",
+		Help:      "Free space of the volume group.",
+	}, []string{"node", "vg"})
+	logicalVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "logical_volumes",
+		Help:      "Number of logical volumes in the volume group by type.",
+	}, []string{"node", "vg", "type"})
+	resticBackupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "restic_backup_duration_seconds",
+		Help:      "Duration of the restic backups of s3 snapshots by repository.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"repository"})
+	resticBackupBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restic_backup_bytes_total",
+		Help:      "Bytes added to the repository by restic backups of s3 snapshots.",
+	}, []string{"repository"})
+	s3Snapshots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_snapshots",
+		Help:      "Number of s3 snapshots in the repository, updated by unfiltered ListSnapshots calls.",
+	}, []string{"repository"})
+)
+
+func init() {
+	prometheus.MustRegister(orphanedVolumes, orphanedVolumeBytes, orphanedVolumesDeleted, pendingDeletions, trimmedBytes,
+		grpcRequestDuration, volumeActionDuration, vgSizeBytes, vgFreeBytes, logicalVolumes, resticBackupDuration, resticBackupBytes, s3Snapshots)
+}
+
+// updateInventoryMetrics publishes the size, free space and logical volumes of the volume group of this node
+func updateInventoryMetrics(node string, vg VolumeGroup, lvs []LogicalVolume) {
+	vgSizeBytes.WithLabelValues(node, vg.Name).Set(float64(vg.Size))
+	vgFreeBytes.WithLabelValues(node, vg.Name).Set(float64(vg.Free))
+	counts := map[string]int{}
+	for _, lv := range lvs {
+		counts[lv.metricType()]++
+	}
+	for _, t := range []string{"linear", "mirror", "raid", "thin", "thinpool", "snapshot", "trashed", "other"} {
+		logicalVolumes.WithLabelValues(node, vg.Name, t).Set(float64(counts[t]))
+	}
+}
+
+// metricType returns the type label of the logical volume in metrics, striped volumes are linear
+func (lv LogicalVolume) metricType() string {
+	switch {
+	case lv.isTrashed():
+		return "trashed"
+	case lv.isSnapshot():
+		return "snapshot"
+	case lv.isThin():
+		return "thin"
+	case lv.isThinPool():
+		return "thinpool"
+	case len(lv.Attr) == 0:
+		return "other"
+	}
+	switch lv.Attr[0] {
+	case '-':
+		return "linear"
+	case 'm', 'M':
+		return "mirror"
+	case 'r', 'R':
+		return "raid"
+	}
+	return "other"
+}
+
+// s3Repository returns the repository label of s3 metrics
+func s3Repository(s3 S3Parameter) string {
+	return s3.Endpoint + "/" + s3.BucketName
+}
+
+// serveMetrics exposes the prometheus metrics on address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	klog.Infof("serving metrics on %s/metrics", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		klog.Errorf("unable to serve metrics: %v", err)
+	}
+}
+
+// recordProvisionerResult publishes the stats reported by a successful provisioner
+func recordProvisionerResult(va volumeAction, result *ProvisionerResult) {
+	if result == nil || result.Backup == nil {
+		return
+	}
+	repository := s3Repository(va.S3Parameter)
+	resticBackupDuration.WithLabelValues(repository).Observe(result.Backup.Seconds)
+	resticBackupBytes.WithLabelValues(repository).Add(float64(result.Backup.BytesAdded))
+}
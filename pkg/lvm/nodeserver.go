@@ -19,7 +19,6 @@ package lvm
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"context"
@@ -40,19 +39,24 @@ type nodeServer struct {
 	ephemeral         bool
 	devicesPattern    string
 	vgName            string
+	// locks of the volumes with an operation in progress
+	locks             *volumeLocks
 }
 
 func newNodeServer(nodeID string, ephemeral bool,  devicesPattern string, vgName string) *nodeServer {
 
 	// revive existing volumes at start of node server
-	vgexists := vgExists(vgName)
+	ctx := context.Background()
+	vgexists, err := vgExists(vgName)
+	if err != nil {
+		klog.Errorf("unable to check volumegroup %s: %v", vgName, err)
+	}
 	if !vgexists {
 		klog.Infof("volumegroup: %s not found\n", vgName)
-		vgActivate(vgName)
+		vgActivate(ctx, vgName)
 		// now check again for existing vg again
 	}
-	cmd := exec.Command("lvchange", "-ay", vgName)
-	out, err := cmd.CombinedOutput()
+	out, err := lvmCommand(ctx, "lvchange", "-ay", vgName)
 	if err != nil {
 		klog.Infof("unable to activate logical volumes:%s %v", out, err)
 	}
@@ -62,6 +66,7 @@ func newNodeServer(nodeID string, ephemeral bool,  devicesPattern string, vgName
 		ephemeral:         ephemeral,
 		devicesPattern:    devicesPattern,
 		vgName:            vgName,
+		locks:             newVolumeLocks(),
 	}
 }
 
@@ -80,6 +85,15 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	targetPath := req.GetTargetPath()
 
+	volID, err := ns.volumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if err := ns.locks.tryAcquire(volID.lvName, "NodePublishVolume"); err != nil {
+		return nil, err
+	}
+	defer ns.locks.release(volID.lvName)
+
 	if req.GetVolumeCapability().GetBlock() != nil &&
 		req.GetVolumeCapability().GetMount() != nil {
 		return nil, status.Error(codes.InvalidArgument, "cannot have both block and mount access type")
@@ -115,38 +129,69 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("failed to parse size(%s) of ephemeral inline volume: %s", val, err.Error()))
 		}
 
-		volID := req.GetVolumeId()
-
-		output, err := CreateVG(ns.vgName, ns.devicesPattern)
+		output, err := CreateVG(ctx, ns.vgName, ns.devicesPattern)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create vg: %v output:%s", err, output)
 		}
 
-		output, err = CreateLVS(context.Background(), ns.vgName, volID, uint64(size), req.GetVolumeContext()["type"])
+		wipePolicy := req.GetVolumeContext()[wipePolicyParameter]
+		if err := ValidateWipePolicy(wipePolicy); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		output, err = CreateLVS(context.Background(), ns.vgName, volID.lvName, uint64(size), req.GetVolumeContext()["type"], WipeTags(wipePolicy)...)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create lv: %v output:%s", err, output)
 		}
 
 		klog.V(4).Infof("ephemeral mode: created volume: %s, size: %d", volID, size)
+	} else {
+		// imported volumes and volumes of a restarted node may not be active
+		lv, err := getLV(volID.vgName, volID.lvName)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "unable to find lv %s: %v", volID, err)
+		}
+		output, err := activateLV(ctx, volID.vgName, lv)
+		if err != nil {
+			return nil, fmt.Errorf("unable to activate lv: %v output:%s", err, output)
+		}
+	}
+
+	if err := validateTrimParameters(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	if req.GetVolumeCapability().GetBlock() != nil {
 
-		output, err := bindMountLV(req.GetVolumeId(), targetPath, ns.vgName)
+		output, err := bindMountLV(ctx, volID.lvName, targetPath, volID.vgName)
 		if err != nil {
 			return nil, fmt.Errorf("unable to bind mount lv: %v output:%s", err, output)
 		}
 		// FIXME: VolumeCapability is a struct and not the size
-		klog.Infof("block lv %s size:%s vg:%s devices:%s created at:%s", req.GetVolumeId(), req.GetVolumeCapability(), ns.vgName, ns.devicesPattern, targetPath)
+		klog.Infof("block lv %s size:%s vg:%s devices:%s created at:%s", volID.lvName, req.GetVolumeCapability(), volID.vgName, ns.devicesPattern, targetPath)
 
 	} else if req.GetVolumeCapability().GetMount() != nil {
 
-		output, err := mountLV(req.GetVolumeId(), targetPath, ns.vgName)
+		mount := req.GetVolumeCapability().GetMount()
+		mountFlags := mount.GetMountFlags()
+		if mountDiscard(req.GetVolumeContext()) {
+			mountFlags = append(mountFlags, "discard")
+		}
+		output, err := mountLV(ctx, volID.lvName, targetPath, volID.vgName, mount.GetFsType(), mountFlags)
 		if err != nil {
 			return nil, fmt.Errorf("unable to mount lv: %v output:%s", err, output)
 		}
+		// the trimmer of the node plugin reads the interval of the storage class from the logical volume
+		lv, err := getLV(volID.vgName, volID.lvName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read lv: %v", err)
+		}
+		output, err = setTrimInterval(ctx, volID.vgName, lv, req.GetVolumeContext()[trimIntervalParameter])
+		if err != nil {
+			return nil, fmt.Errorf("unable to set trim interval of lv: %v output:%s", err, output)
+		}
 		// FIXME: VolumeCapability is a struct and not the size
-		klog.Infof("mounted lv %s size:%s vg:%s devices:%s created at:%s", req.GetVolumeId(), req.GetVolumeCapability(), ns.vgName, ns.devicesPattern, targetPath)
+		klog.Infof("mounted lv %s size:%s vg:%s devices:%s created at:%s", volID.lvName, req.GetVolumeCapability(), volID.vgName, ns.devicesPattern, targetPath)
 
 	}
 
@@ -157,30 +202,36 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	// TODO
 	// implement deletion of ephemeral volumes
-	volID := req.GetVolumeId()
-
 	klog.Infof("NodeUnpublishRequest: %s", req)
 	// Check arguments
-	if len(volID) == 0 {
+	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	volID, err := ns.volumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := ns.locks.tryAcquire(volID.lvName, "NodeUnpublishVolume"); err != nil {
+		return nil, err
+	}
+	defer ns.locks.release(volID.lvName)
 
-	output, err := umountLV(req.GetTargetPath())
+	output, err := umountLV(ctx, req.GetTargetPath())
 	if err != nil {
 		return nil, fmt.Errorf("unable to umount lv: %v output:%s", err, output)
 	}
 
 	// ephemeral volumes start with "csi-"
-	if strings.HasPrefix(volID, "csi-") {
+	if strings.HasPrefix(volID.lvName, "csi-") {
 		// remove ephemeral volume here
-		output, err := RemoveLVS(context.Background(), ns.vgName, volID)
+		output, err := RemoveLVS(context.Background(), volID.vgName, volID.lvName)
 		if err != nil {
 			return nil, fmt.Errorf("unable to delete lv: %v output:%s", err, output)
 		}
-		klog.Infof("lv %s vg:%s deleted", volID, ns.vgName)
+		klog.Infof("lv %s vg:%s deleted", volID.lvName, volID.vgName)
 
 	}
 
@@ -304,11 +355,18 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
 	}
 
-	volID := req.GetVolumeId()
+	volID, err := ns.volumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
 	volPath := req.GetVolumePath()
 	if len(volPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
 	}
+	if err := ns.locks.tryAcquire(volID.lvName, "NodeExpandVolume"); err != nil {
+		return nil, err
+	}
+	defer ns.locks.release(volID.lvName)
 
 	info, err := os.Stat(volPath)
 	if err != nil {
@@ -322,7 +380,7 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		isBlock = true
 	}
 
-	output, err := extendLVS(context.Background(), ns.vgName, volID, uint64(capacity), isBlock)
+	output, err := extendLVS(context.Background(), volID.vgName, volID.lvName, uint64(capacity), isBlock)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to umount lv: %v output:%s", err, output)
@@ -0,0 +1,174 @@
+package lvm
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// orphanCollector finds logical volumes of the driver on this node which are not referenced by any persistent volume,
+// e.g. because the deletion timed out or the node was gone during DeleteVolume. Orphans are reported as metrics and
+// events on the node and optionally removed after a grace period.
+type orphanCollector struct {
+	kubeClient  kubernetes.Clientset
+	pvs         *pvCache
+	driverName  string
+	nodeID      string
+	vgName      string
+	interval    int
+	gracePeriod time.Duration
+	delete      bool
+	// trashRetention keeps deleted orphans in the trash
+	trashRetention time.Duration
+
+	recorder record.EventRecorder
+	// firstSeen is the time a logical volume was detected as orphan first
+	firstSeen map[string]time.Time
+}
+
+func newOrphanCollector(kubeClient kubernetes.Clientset, pvs *pvCache, driverName string, nodeID string, vgName string, interval int, gracePeriod time.Duration, delete bool, trashRetention time.Duration) *orphanCollector {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return &orphanCollector{
+		kubeClient:     kubeClient,
+		pvs:            pvs,
+		driverName:     driverName,
+		nodeID:         nodeID,
+		vgName:         vgName,
+		interval:       interval,
+		gracePeriod:    gracePeriod,
+		delete:         delete,
+		trashRetention: trashRetention,
+		recorder:       broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeID}),
+		firstSeen:      map[string]time.Time{},
+	}
+}
+
+func (oc *orphanCollector) run() {
+	for {
+		time.Sleep(time.Duration(oc.interval) * time.Second)
+		err := oc.collect()
+		if err != nil {
+			klog.Errorf("unable to collect orphaned volumes: %v", err)
+		}
+	}
+}
+
+func (oc *orphanCollector) collect() error {
+	if exists, err := vgExists(oc.vgName); err != nil || !exists {
+		return err
+	}
+	lvs, err := ListLVs(oc.vgName)
+	if err != nil {
+		return err
+	}
+	// never guess orphans without the complete list of persistent volumes
+	referenced, err := oc.referencedVolumes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	orphans := map[string]bool{}
+	var orphanBytes int64
+	for _, lv := range lvs {
+		if !isOrphan(lv, referenced) {
+			continue
+		}
+		orphans[lv.Name] = true
+		orphanBytes += lv.Size
+
+		first, known := oc.firstSeen[lv.Name]
+		if !known {
+			first = now
+			oc.firstSeen[lv.Name] = now
+			klog.Warningf("logical volume %s/%s is not referenced by any persistent volume", oc.vgName, lv.Name)
+			oc.event(v1.EventTypeWarning, "OrphanedVolume", "logical volume %s/%s of size %d is not referenced by any persistent volume", oc.vgName, lv.Name, lv.Size)
+		}
+		if !oc.delete || now.Sub(first) < oc.gracePeriod || lv.isOpen() {
+			continue
+		}
+
+		// like deleted volumes, orphans are kept in the trash if a retention is configured
+		var out string
+		withNodeSlot(func() {
+			out, err = DeleteLV(context.Background(), oc.vgName, lv.Name, oc.trashRetention)
+		})
+		if err != nil {
+			klog.Errorf("unable to remove orphaned logical volume %s: %v output:%s", lv.Name, err, out)
+			continue
+		}
+		klog.Infof("orphaned logical volume %s/%s removed", oc.vgName, lv.Name)
+		oc.event(v1.EventTypeNormal, "OrphanedVolumeDeleted", "orphaned logical volume %s/%s removed after %s", oc.vgName, lv.Name, now.Sub(first).Round(time.Second))
+		orphanedVolumesDeleted.WithLabelValues(oc.nodeID).Inc()
+		delete(orphans, lv.Name)
+		orphanBytes -= lv.Size
+	}
+
+	for name := range oc.firstSeen {
+		if !orphans[name] {
+			delete(oc.firstSeen, name)
+		}
+	}
+	orphanedVolumes.WithLabelValues(oc.nodeID).Set(float64(len(orphans)))
+	orphanedVolumeBytes.WithLabelValues(oc.nodeID).Set(float64(orphanBytes))
+	return nil
+}
+
+// referencedVolumes returns the names of the logical volumes on this node used by persistent volumes of the driver
+func (oc *orphanCollector) referencedVolumes() (map[string]bool, error) {
+	pvs, err := oc.pvs.list()
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != oc.driverName {
+			continue
+		}
+		volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			continue
+		}
+		if volID.isLegacy() {
+			// without node affinity the volume might be located on any node
+			if node := pvNode(pv); node != "" && node != oc.nodeID {
+				continue
+			}
+		} else if volID.node != oc.nodeID || volID.vgName != oc.vgName {
+			continue
+		}
+		referenced[volID.lvName] = true
+	}
+	return referenced, nil
+}
+
+// isOrphan returns true for logical volumes of the driver which are not referenced. Ephemeral volumes are only
+// orphans if they are not in use, snapshots and trashed volumes are never orphans.
+func isOrphan(lv LogicalVolume, referenced map[string]bool) bool {
+	if !lv.hasTag(lvmDriverTag) || lv.hasTag(localSnapshotTag) || lv.isSnapshot() || lv.isTrashed() {
+		return false
+	}
+	if strings.HasPrefix(lv.Name, "csi-") {
+		return !lv.isOpen()
+	}
+	return !referenced[lv.Name]
+}
+
+func (oc *orphanCollector) event(eventtype, reason, messageFmt string, args ...interface{}) {
+	node := &v1.ObjectReference{
+		Kind: "Node",
+		Name: oc.nodeID,
+		// events of nodes are referenced by the node name
+		UID: types.UID(oc.nodeID),
+	}
+	oc.recorder.Eventf(node, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,257 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	placementMostFree  = "most-free"
+	placementLeastFree = "least-free"
+	placementSpread    = "spread"
+
+	// placementPolicyParameter selects the placement policy in the storage class
+	placementPolicyParameter = "placementPolicy"
+
+	// set by the external-provisioner with --extra-create-metadata
+	pvcNameParameter      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParameter = "csi.storage.k8s.io/pvc/namespace"
+	// set by the scheduler on claims of storage classes with WaitForFirstConsumer binding
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+)
+
+// nodeCandidate is a node a new volume fits on
+type nodeCandidate struct {
+	node    string
+	free    int64
+	volumes int
+}
+
+// placementPolicy selects the node for a new volume among the candidates, candidates are sorted by node name
+type placementPolicy interface {
+	selectNode(candidates []nodeCandidate) string
+}
+
+// mostFreePolicy distributes volumes to the nodes with the most free space
+type mostFreePolicy struct{}
+
+func (mostFreePolicy) selectNode(candidates []nodeCandidate) string {
+	selected := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.free > selected.free {
+			selected = c
+		}
+	}
+	return selected.node
+}
+
+// leastFreePolicy packs volumes onto the nodes with the least free space which still fit
+type leastFreePolicy struct{}
+
+func (leastFreePolicy) selectNode(candidates []nodeCandidate) string {
+	selected := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.free < selected.free {
+			selected = c
+		}
+	}
+	return selected.node
+}
+
+// spreadPolicy distributes volumes to the nodes with the fewest volumes, ties are broken by free space
+type spreadPolicy struct{}
+
+func (spreadPolicy) selectNode(candidates []nodeCandidate) string {
+	selected := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.volumes < selected.volumes || c.volumes == selected.volumes && c.free > selected.free {
+			selected = c
+		}
+	}
+	return selected.node
+}
+
+func newPlacementPolicy(name string) (placementPolicy, error) {
+	switch name {
+	case placementMostFree, "":
+		return mostFreePolicy{}, nil
+	case placementLeastFree:
+		return leastFreePolicy{}, nil
+	case placementSpread:
+		return spreadPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy %s, must be one of %s, %s, %s", name, placementMostFree, placementLeastFree, placementSpread)
+}
+
+// selectNode returns the node to create a volume on. With WaitForFirstConsumer binding this is the node of the
+// scheduled pod, otherwise the node is selected among the requisite topologies by the placement policy.
+func (cs *controllerServer) selectNode(req *csi.CreateVolumeRequest, lvmType string) (string, error) {
+	node, err := cs.scheduledNode(req)
+	if err != nil || node != "" {
+		return node, err
+	}
+
+	// clones and restored local snapshots must be created on the node of their source
+	if source := req.GetVolumeContentSource().GetVolume(); source != nil {
+		inv, _, err := cs.findVolume(source.GetVolumeId())
+		if err != nil {
+			return "", err
+		}
+		return inv.Node, nil
+	}
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil && isLocalSnapshotID(snapshot.GetSnapshotId()) {
+		snap, err := parseLocalSnapshotID(snapshot.GetSnapshotId())
+		if err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		return snap.node, nil
+	}
+
+	// a retry must not place the volume on another node than the previous attempt
+	node, err = cs.existingVolumeNode(req.GetName())
+	if err != nil || node != "" {
+		return node, err
+	}
+
+	policy := cs.placementPolicy
+	if p := req.GetParameters()[placementPolicyParameter]; p != "" {
+		var err error
+		policy, err = newPlacementPolicy(p)
+		if err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	candidates, err := cs.placementCandidates(req.GetAccessibilityRequirements(), req.GetCapacityRange().GetRequiredBytes(), lvmType)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", status.Errorf(codes.ResourceExhausted, "no node has %d bytes free for %s volume %s", req.GetCapacityRange().GetRequiredBytes(), lvmType, req.GetName())
+	}
+	node = policy.selectNode(candidates)
+	klog.Infof("placement of volume %s: selected node %s out of %d candidates", req.GetName(), node, len(candidates))
+	return node, nil
+}
+
+// scheduledNode returns the node selected by the scheduler, or an empty string for immediate binding
+func (cs *controllerServer) scheduledNode(req *csi.CreateVolumeRequest) (string, error) {
+	// without metadata the binding mode is unknown, the first preferred topology is the node of the scheduled pod
+	// for WaitForFirstConsumer storage classes
+	preferredNode := ""
+	if preferred := req.GetAccessibilityRequirements().GetPreferred(); len(preferred) > 0 {
+		preferredNode = preferred[0].GetSegments()[topologyKeyNode]
+	}
+	pvcName := req.GetParameters()[pvcNameParameter]
+	pvcNamespace := req.GetParameters()[pvcNamespaceParameter]
+	if pvcName == "" || pvcNamespace == "" {
+		return preferredNode, nil
+	}
+
+	pvc, err := cs.kubeClient.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(context.Background(), pvcName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("unable to read claim %s/%s of volume %s: %v", pvcNamespace, pvcName, req.GetName(), err)
+		if preferredNode != "" {
+			return preferredNode, nil
+		}
+		return "", status.Errorf(codes.Unavailable, "unable to read claim %s/%s to determine its binding: %v", pvcNamespace, pvcName, err)
+	}
+	return pvc.Annotations[selectedNodeAnnotation], nil
+}
+
+// existingVolumeNode returns the node a previous attempt already created the volume on or started its provisioner job
+// on, or an empty string if there is none
+func (cs *controllerServer) existingVolumeNode(name string) (string, error) {
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
+	}
+	for _, inv := range invs {
+		if lv := inv.findLV(name); lv != nil && lv.VGName == cs.vgName {
+			klog.Infof("placement of volume %s: already created on node %s", name, inv.Node)
+			return inv.Node, nil
+		}
+	}
+
+	job, err := cs.kubeClient.BatchV1().Jobs(cs.namespace).Get(context.Background(), labelValue(actionTypeCreate+"-"+name), metav1.GetOptions{})
+	if k8serror.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "unable to read provisioner job of volume %s: %v", name, err)
+	}
+	if job.DeletionTimestamp != nil {
+		return "", nil
+	}
+	klog.Infof("placement of volume %s: provisioner job already started on node %s", name, job.Spec.Template.Spec.NodeName)
+	return job.Spec.Template.Spec.NodeName, nil
+}
+
+// placementCandidates returns the nodes allowed by the topology requirement which have enough free space for the volume
+func (cs *controllerServer) placementCandidates(requirement *csi.TopologyRequirement, size int64, lvmType string) ([]nodeCandidate, error) {
+	allowed := map[string]bool{}
+	topologies := requirement.GetRequisite()
+	if len(topologies) == 0 {
+		topologies = requirement.GetPreferred()
+	}
+	for _, t := range topologies {
+		if node := t.GetSegments()[topologyKeyNode]; node != "" {
+			allowed[node] = true
+		}
+	}
+
+	invs, err := listInventories(cs.kubeClient, cs.namespace)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read lvm inventories: %v", err)
+	}
+
+	required := size
+	minPVs := 1
+	switch lvmType {
+	case mirrorType:
+		required = 2 * size
+		minPVs = 2
+	case stripedType:
+		minPVs = 2
+	}
+
+	var candidates, reclaimable, uninitialized []nodeCandidate
+	for _, inv := range invs {
+		if len(allowed) > 0 && !allowed[inv.Node] {
+			continue
+		}
+		if inv.isStale(cs.inventoryInterval) {
+			klog.V(4).Infof("skipping node %s for placement, lvm inventory is outdated", inv.Node)
+			continue
+		}
+		if inv.VG == nil {
+			// the volume group is created with the first volume, its size is unknown
+			uninitialized = append(uninitialized, nodeCandidate{node: inv.Node})
+			continue
+		}
+		if inv.VG.PVCount < minPVs {
+			continue
+		}
+		candidate := nodeCandidate{node: inv.Node, free: inv.VG.Free, volumes: len(inv.volumes())}
+		if inv.VG.Free >= required {
+			candidates = append(candidates, candidate)
+		} else if inv.VG.Free+inv.reclaimableBytes() >= required {
+			// the provisioner removes trashed volumes to make room
+			reclaimable = append(reclaimable, candidate)
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+	if len(reclaimable) > 0 {
+		return reclaimable, nil
+	}
+	return uninitialized, nil
+}
@@ -0,0 +1,90 @@
+package lvm
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// loadPodTemplate reads the pod template of the provisioner jobs, the first container of the template customizes
+// the provisioner container
+func loadPodTemplate(path string) (*v1.PodTemplateSpec, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read provisioner pod template %s: %v", path, err)
+	}
+	template := &v1.PodTemplateSpec{}
+	if err := yaml.UnmarshalStrict(data, template); err != nil {
+		return nil, fmt.Errorf("invalid provisioner pod template %s: %v", path, err)
+	}
+	if len(template.Spec.Containers) > 1 {
+		return nil, fmt.Errorf("invalid provisioner pod template %s: only one container is allowed", path)
+	}
+	return template, nil
+}
+
+// mergePodTemplate returns the pod template of the operator with the fields required by the provisioner. The node,
+// restart policy, command, arguments and privileges of the provisioner can not be changed. Required volumes are
+// replaced by template volumes of the same name, e.g. to use other host paths. Without tolerations in the template
+// the provisioner tolerates everything.
+func mergePodTemplate(required v1.PodTemplateSpec, template *v1.PodTemplateSpec) v1.PodTemplateSpec {
+	if template == nil {
+		return required
+	}
+	merged := template.DeepCopy()
+
+	if merged.Labels == nil {
+		merged.Labels = map[string]string{}
+	}
+	for k, v := range required.Labels {
+		merged.Labels[k] = v
+	}
+
+	merged.Spec.NodeName = required.Spec.NodeName
+	merged.Spec.RestartPolicy = required.Spec.RestartPolicy
+	if len(merged.Spec.Tolerations) == 0 {
+		merged.Spec.Tolerations = required.Spec.Tolerations
+	}
+
+	templateVolumes := map[string]bool{}
+	for _, volume := range merged.Spec.Volumes {
+		templateVolumes[volume.Name] = true
+	}
+	for _, volume := range required.Spec.Volumes {
+		if !templateVolumes[volume.Name] {
+			merged.Spec.Volumes = append(merged.Spec.Volumes, volume)
+		}
+	}
+
+	container := required.Spec.Containers[0]
+	if len(merged.Spec.Containers) > 0 {
+		t := merged.Spec.Containers[0]
+		if t.Image != "" {
+			container.Image = t.Image
+		}
+		if t.ImagePullPolicy != "" {
+			container.ImagePullPolicy = t.ImagePullPolicy
+		}
+		container.Resources = t.Resources
+		// the environment of the driver comes last and wins
+		container.Env = append(t.Env, container.Env...)
+		container.EnvFrom = t.EnvFrom
+
+		requiredMounts := map[string]bool{}
+		for _, mount := range container.VolumeMounts {
+			requiredMounts[mount.MountPath] = true
+		}
+		for _, mount := range t.VolumeMounts {
+			if !requiredMounts[mount.MountPath] {
+				container.VolumeMounts = append(container.VolumeMounts, mount)
+			}
+		}
+	}
+	merged.Spec.Containers = []v1.Container{container}
+	return *merged
+}
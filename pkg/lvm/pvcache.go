@@ -0,0 +1,59 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// pvCacheSyncTimeout is the time to wait for the initial list of persistent volumes
+const pvCacheSyncTimeout = time.Minute
+
+// pvCache holds the persistent volumes of the cluster, it is shared by the periodic loops of the plugin
+// instead of listing all persistent volumes in every loop
+type pvCache struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.PersistentVolumeLister
+	synced  cache.InformerSynced
+	// stop is never closed, the informer runs as long as the plugin
+	stop chan struct{}
+}
+
+func newPVCache(kubeClient kubernetes.Interface) *pvCache {
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	pvs := factory.Core().V1().PersistentVolumes()
+	return &pvCache{
+		factory: factory,
+		lister:  pvs.Lister(),
+		synced:  pvs.Informer().HasSynced,
+		stop:    make(chan struct{}),
+	}
+}
+
+// start watches the persistent volumes and waits at most pvCacheSyncTimeout until the cache is filled, the informer
+// keeps trying afterwards
+func (p *pvCache) start() {
+	p.factory.Start(p.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), pvCacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), p.synced) {
+		klog.Errorf("persistent volumes not synced after %s, periodic loops are skipped until they are", pvCacheSyncTimeout)
+	}
+}
+
+// list returns the cached persistent volumes, they must not be modified. An error is returned until the cache is
+// filled, the callers must not act on an incomplete list.
+func (p *pvCache) list() ([]*v1.PersistentVolume, error) {
+	if !p.synced() {
+		return nil, fmt.Errorf("persistent volumes are not synced yet")
+	}
+	return p.lister.List(labels.Everything())
+}
@@ -0,0 +1,165 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// lvmLockRetries is the number of retries of lvm commands which failed on a lock held by a concurrent command
+	lvmLockRetries = 5
+	lvmLockBackoff = 1 * time.Second
+
+	// MaxNodeOperationsEnv passes the maximum number of concurrent lvm operations of a node to the provisioner
+	MaxNodeOperationsEnv = "CSI_LVM_MAX_NODE_OPERATIONS"
+	// nodeSlotDir holds the slot files of the node, the lvm lock directory is mounted into the plugin and provisioner
+	nodeSlotDir      = "/run/lock/lvm"
+	nodeSlotInterval = 1 * time.Second
+)
+
+// maxNodeOperations limits the lvm operations of the node plugin itself, set from the configuration
+var maxNodeOperations int
+
+// lvmNotFoundPattern matches the errors of lvm queries for missing volume groups and logical volumes
+var lvmNotFoundPattern = regexp.MustCompile(`(?i)(not found|failed to find)`)
+
+// lvmLockErrorPattern matches the errors of lvm commands which could not acquire the lock of the volume group
+var lvmLockErrorPattern = regexp.MustCompile(`(?i)(can't get lock|failed to lock|giving up waiting for lock|lock file .* busy|resource temporarily unavailable)`)
+
+// nodeQueue limits the number of volume actions the controller runs concurrently on each node, concurrent lvm
+// commands contend on the lvm lock of the node. The queue only covers the actions of this controller until they
+// return, the limit is enforced on the node by AcquireNodeSlot.
+type nodeQueue struct {
+	mu sync.Mutex
+	// max number of concurrent actions per node, unlimited if 0
+	max   int
+	slots map[string]chan struct{}
+}
+
+func newNodeQueue(max int) *nodeQueue {
+	return &nodeQueue{max: max, slots: map[string]chan struct{}{}}
+}
+
+// acquire waits for a free slot on the node, it must be released if no error is returned
+func (q *nodeQueue) acquire(ctx context.Context, node string) error {
+	if q.max <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	slots, ok := q.slots[node]
+	if !ok {
+		slots = make(chan struct{}, q.max)
+		q.slots[node] = slots
+	}
+	q.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	klog.Infof("waiting for one of %d running volume actions on node %s", q.max, node)
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *nodeQueue) release(node string) {
+	if q.max <= 0 {
+		return
+	}
+	q.mu.Lock()
+	slots := q.slots[node]
+	q.mu.Unlock()
+	<-slots
+}
+
+// AcquireNodeSlot waits until one of max slots of this node is free, the returned function releases it. The slots are
+// flocks on files shared by the node plugin and the provisioner processes of jobs and agents, the kernel releases the
+// slot of a process which exits. An abandoned provisioner job keeps its slot until it finished. max <= 0 is unlimited.
+func AcquireNodeSlot(ctx context.Context, max int) (func(), error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+	waiting := false
+	for {
+		for i := 0; i < max; i++ {
+			f, err := os.OpenFile(filepath.Join(nodeSlotDir, fmt.Sprintf("csi-lvm-operation-%d", i)), os.O_CREATE|os.O_RDWR, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open node slot: %v", err)
+			}
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				return func() { f.Close() }, nil
+			}
+			f.Close()
+			if err != syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("unable to lock node slot: %v", err)
+			}
+		}
+		if !waiting {
+			klog.Infof("waiting for one of %d running lvm operations on this node", max)
+			waiting = true
+		}
+		select {
+		case <-time.After(nodeSlotInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// withNodeSlot runs fn in a slot of the node, it is used for the lvm operations of the periodic loops of the plugin
+func withNodeSlot(fn func()) {
+	release, err := AcquireNodeSlot(context.Background(), maxNodeOperations)
+	if err != nil {
+		klog.Errorf("unable to acquire node slot: %v", err)
+		return
+	}
+	defer release()
+	fn()
+}
+
+// lvmCommand runs the lvm command and retries it with backoff if it failed because a concurrent command held the lock.
+// The command is killed and the retries are abandoned if ctx is done.
+func lvmCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return retryLVMLock(ctx, name, func() ([]byte, error) {
+		return runCommand(ctx, exec.CommandContext(ctx, name, args...))
+	})
+}
+
+// lvmQuery runs a read-only lvm command, it is retried like lvmCommand but not traced
+func lvmQuery(name string, args ...string) ([]byte, error) {
+	return retryLVMLock(context.Background(), name, func() ([]byte, error) {
+		return exec.Command(name, args...).CombinedOutput()
+	})
+}
+
+func retryLVMLock(ctx context.Context, name string, run func() ([]byte, error)) ([]byte, error) {
+	backoff := lvmLockBackoff
+	for i := 0; ; i++ {
+		out, err := run()
+		if err == nil || i >= lvmLockRetries || !lvmLockErrorPattern.Match(out) {
+			return out, err
+		}
+		klog.Warningf("%s failed on the lvm lock, retrying in %s: %v output:%s", name, backoff, err, out)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return out, fmt.Errorf("%s abandoned while waiting for the lvm lock: %v", name, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
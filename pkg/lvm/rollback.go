@@ -0,0 +1,236 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// rollbackAnnotation on a persistent volume requests the rollback of the volume to the given local snapshot id
+	rollbackAnnotation = "csi-lvm.metal-stack.io/rollback"
+	// rollbackStatusAnnotation reports the state of the last requested rollback
+	rollbackStatusAnnotation = "csi-lvm.metal-stack.io/rollback-status"
+
+	rollbackStatusPending   = "pending"
+	rollbackStatusMerging   = "merging"
+	rollbackStatusCompleted = "completed"
+	rollbackStatusFailed    = "failed"
+
+	actionTypeRollback = "rollback"
+)
+
+// ErrVolumeInUse is returned by MergeLocalSnapshot if the volume is published, the rollback is retried later
+var ErrVolumeInUse = errors.New("volume is in use")
+
+// ErrVolumeMerging is returned for volumes which are rolled back to a local snapshot, the operation is retried later
+var ErrVolumeMerging = errors.New("volume is rolled back to a local snapshot")
+
+// checkNotMerging returns ErrVolumeMerging if the logical volume is part of a running snapshot merge, missing volumes
+// are reported by the caller
+func checkNotMerging(vg string, name string) error {
+	lv, err := getLV(vg, name)
+	if err != nil {
+		return nil
+	}
+	if lv.isMerging() {
+		return fmt.Errorf("logical volume %s: %w", name, ErrVolumeMerging)
+	}
+	return nil
+}
+
+// checkRollback returns Aborted while the volume is merged with a local snapshot by the node plugin. The lock of the
+// rollback only protects the volume within the node plugin, the provisioner checks the merge again.
+func (cs *controllerServer) checkRollback(lvName string) error {
+	if cs.pvs == nil {
+		return nil
+	}
+	pvs, err := cs.pvs.list()
+	if err != nil {
+		return nil
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Annotations[rollbackAnnotation] == "" || !strings.HasPrefix(pv.Annotations[rollbackStatusAnnotation], rollbackStatusMerging+":") {
+			continue
+		}
+		if volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle); err == nil && volID.lvName == lvName {
+			return status.Errorf(codes.Aborted, "volume %s is rolled back to a local snapshot", lvName)
+		}
+	}
+	return nil
+}
+
+// MergeLocalSnapshot reverts the volume lv to the state of the local snapshot snapLv.
+// The snapshot is removed by lvm after the merge.
+func MergeLocalSnapshot(ctx context.Context, vg string, lv string, snapLv string) (string, error) {
+	snap, err := getLV(vg, snapLv)
+	if err != nil {
+		return "", err
+	}
+	if !snap.hasTag(localSnapshotTag) || snap.Origin != lv {
+		return "", fmt.Errorf("logical volume %s is no local snapshot of %s", snapLv, lv)
+	}
+	origin, err := getLV(vg, lv)
+	if err != nil {
+		return "", err
+	}
+	// lvm would defer the merge of an open volume until its next activation
+	if origin.isOpen() {
+		return "", fmt.Errorf("logical volume %s: %w", lv, ErrVolumeInUse)
+	}
+
+	args := []string{"--merge", "-y", fmt.Sprintf("%s/%s", vg, snapLv)}
+	klog.Infof("lvconvert %s", args)
+	out, err := lvmCommand(ctx, "lvconvert", args...)
+	if err != nil {
+		return string(out), err
+	}
+	return fmt.Sprintf("volume %s successfully rolled back to snapshot %s", lv, snapLv), nil
+}
+
+// runRollbacks processes the rollback requests of volumes on this node every interval seconds
+func (cs *controllerServer) runRollbacks(interval int) {
+	for {
+		pvs, err := cs.pvs.list()
+		if err != nil {
+			klog.Errorf("unable to list persistent volumes: %v", err)
+		} else {
+			for _, pv := range pvs {
+				if _, ok := pv.Annotations[rollbackAnnotation]; !ok || pv.Spec.CSI == nil {
+					continue
+				}
+				volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+				if err != nil {
+					continue
+				}
+				if volID.isLegacy() {
+					volID.node = pvNode(pv)
+					volID.vgName = cs.vgName
+				}
+				if volID.node != cs.nodeID || volID.vgName != cs.vgName {
+					continue
+				}
+				cs.rollback(pv, volID.lvName)
+			}
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// rollback merges the requested local snapshot into the volume once the volume is unpublished.
+// The request annotation is removed when the rollback is finished, successfully or not.
+func (cs *controllerServer) rollback(pv *v1.PersistentVolume, lvName string) {
+	// serializes the rollback with the other operations of this plugin, retried in the next interval. The controller
+	// rejects deletes, snapshots and clones of the volume in the merging state, see checkRollback.
+	if err := cs.locks.tryAcquire(lvName, "Rollback"); err != nil {
+		klog.Infof("rollback of volume %s deferred: %v", pv.Name, err)
+		return
+	}
+	defer cs.locks.release(lvName)
+
+	snapshotID := pv.Annotations[rollbackAnnotation]
+	snap, err := parseLocalSnapshotID(snapshotID)
+	if err != nil {
+		cs.setRollbackStatus(pv, rollbackStatusFailed, err.Error(), true)
+		return
+	}
+	if snap.node != cs.nodeID || snap.vgName != cs.vgName {
+		cs.setRollbackStatus(pv, rollbackStatusFailed, fmt.Sprintf("snapshot %s is not located on node %s", snapshotID, cs.nodeID), true)
+		return
+	}
+
+	snapLv, err := getLV(snap.vgName, snap.lvName)
+	if err != nil {
+		cs.setRollbackStatus(pv, rollbackStatusFailed, fmt.Sprintf("snapshot %s not found", snapshotID), true)
+		return
+	}
+	if snapLv.Origin != lvName {
+		cs.setRollbackStatus(pv, rollbackStatusFailed, fmt.Sprintf("snapshot %s is no snapshot of volume %s", snapshotID, pv.Name), true)
+		return
+	}
+
+	lv, err := getLV(cs.vgName, lvName)
+	if err != nil {
+		klog.Errorf("unable to read volume %s: %v", lvName, err)
+		return
+	}
+	if lv.isOpen() {
+		cs.setRollbackStatus(pv, rollbackStatusPending, fmt.Sprintf("waiting for volume to be unpublished to roll back to snapshot %s", snapshotID), false)
+		return
+	}
+
+	cs.setRollbackStatus(pv, rollbackStatusMerging, fmt.Sprintf("rolling back to snapshot %s", snapshotID), false)
+	va := volumeAction{
+		action:           actionTypeRollback,
+		name:             lvName,
+		snapshotName:     snap.lvName,
+		nodeName:         cs.nodeID,
+		pullPolicy:       cs.pullPolicy,
+		provisionerImage: cs.provisionerImage,
+		kubeClient:       cs.kubeClient,
+		namespace:        cs.namespace,
+		vgName:           cs.vgName,
+		pvc:              pv.Spec.ClaimRef,
+	}
+	err = cs.runVolumeAction(context.Background(), va, cs.settings.get().SnapshotTimeout)
+	if status.Code(err) == codes.FailedPrecondition {
+		// published again since the check above
+		cs.setRollbackStatus(pv, rollbackStatusPending, fmt.Sprintf("waiting for volume to be unpublished to roll back to snapshot %s", snapshotID), false)
+		return
+	}
+	if err != nil {
+		klog.Errorf("rollback of volume %s to snapshot %s failed: %v", pv.Name, snapshotID, err)
+		cs.setRollbackStatus(pv, rollbackStatusFailed, fmt.Sprintf("rollback to snapshot %s failed: %v", snapshotID, err), true)
+		return
+	}
+	cs.setRollbackStatus(pv, rollbackStatusCompleted, fmt.Sprintf("rolled back to snapshot %s", snapshotID), true)
+}
+
+// setRollbackStatus reports the rollback state on the persistent volume
+func (cs *controllerServer) setRollbackStatus(pv *v1.PersistentVolume, state string, message string, done bool) {
+	current, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("unable to read persistent volume %s: %v", pv.Name, err)
+		return
+	}
+	if _, ok := current.Annotations[rollbackAnnotation]; !ok {
+		// request withdrawn in the meantime
+		return
+	}
+	value := fmt.Sprintf("%s: %s", state, message)
+	if current.Annotations[rollbackStatusAnnotation] == value && !done {
+		return
+	}
+	klog.Infof("rollback of volume %s %s", pv.Name, value)
+	current.Annotations[rollbackStatusAnnotation] = value
+	if done {
+		delete(current.Annotations, rollbackAnnotation)
+	}
+	_, err = cs.kubeClient.CoreV1().PersistentVolumes().Update(context.Background(), current, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Errorf("unable to update rollback status of persistent volume %s: %v", pv.Name, err)
+	}
+}
+
+// pvNode returns the node of a persistent volume from its node affinity
+func pvNode(pv *v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == topologyKeyNode && len(expr.Values) > 0 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
@@ -1,6 +1,7 @@
 package lvm
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -30,6 +31,19 @@ type resticStats struct {
 	TotalFileCount int64 `json:"total_file_count"`
 }
 
+// resticBackupSummary is the last message of restic backup --json
+type resticBackupSummary struct {
+	MessageType   string  `json:"message_type"`
+	DataAdded     int64   `json:"data_added"`
+	TotalDuration float64 `json:"total_duration"`
+}
+
+// BackupStats describes the restic backup of a s3 snapshot
+type BackupStats struct {
+	Seconds    float64 `json:"seconds"`
+	BytesAdded int64   `json:"bytesAdded"`
+}
+
 type s3Snapshot struct {
 	Time         time.Time `json:"time"`
 	ID           string    `json:"id"`
@@ -46,17 +60,20 @@ type S3Parameter struct {
 	BucketName string `json:"bucketname"`
 }
 
-// CreateS3Snapshot creates a new backup snapshot
-func CreateS3Snapshot(vg string, lv string, snapshotName string, size uint64, s3 S3Parameter, lvmSnapshotBufferPercentage int) (string, error) {
+// CreateS3Snapshot creates a new backup snapshot, the stats of the backup are returned if restic reported them
+func CreateS3Snapshot(ctx context.Context, vg string, lv string, snapshotName string, size uint64, s3 S3Parameter, lvmSnapshotBufferPercentage int) (string, *BackupStats, error) {
+	if err := checkNotMerging(vg, lv); err != nil {
+		return "", nil, err
+	}
 	// check if we have to initialize restic
 	args := []string{"stats"}
-	_, err := execResticCmd("", s3, args...)
+	_, err := execResticCmd(ctx, "", s3, args...)
 	if err != nil {
 		klog.Infof("first snapshot ever, initializing")
 		args := []string{"init"}
-		out, err := execResticCmd("", s3, args...)
+		out, err := execResticCmd(ctx, "", s3, args...)
 		if err != nil {
-			return "", fmt.Errorf("failed to init snapshots: %s %s", err, out)
+			return "", nil, fmt.Errorf("failed to init snapshots: %s %s", err, out)
 		}
 	}
 
@@ -66,30 +83,30 @@ func CreateS3Snapshot(vg string, lv string, snapshotName string, size uint64, s3
 	snapLv := "s-" + snapshotName
 
 	defer func() {
-		cmdout, err := umountLV(mountPath)
+		cmdout, err := umountLV(ctx, mountPath)
 		if err != nil {
 			klog.Errorf("unable to umount directory %s for snapshot:%s err:%v %s", mountPath, snapshotName, err, cmdout)
 		}
-		out, err := DeleteLVMSnapshot(vg, snapLv)
+		out, err := DeleteLVMSnapshot(ctx, vg, snapLv)
 		if err != nil {
 			klog.Errorf("unable to remove snapshot directory %s for snapshot:%s err:%v %s", mountPath, snapshotName, err, out)
 		}
 	}()
 
-	if s3SnapshotExists(snapshotName, s3) {
-		return "", fmt.Errorf("A snapshot with name %s already exists", snapshotName)
+	if s3SnapshotExists(ctx, snapshotName, s3) {
+		return "", nil, fmt.Errorf("A snapshot with name %s already exists", snapshotName)
 	}
 
 	// lvm: Names starting "snapshot" are reserved.
-	out, err := CreateLVMSnapshot(vg, lv, snapLv,  uint64(float64(size)*float64(lvmSnapshotBufferPercentage)/100))
+	out, err := CreateLVMSnapshot(ctx, vg, lv, snapLv,  uint64(float64(size)*float64(lvmSnapshotBufferPercentage)/100))
 	if err != nil {
-		return out, err
+		return out, nil, err
 	}
-	cmdout, err := mountLV(snapLv, mountPath, vg)
+	cmdout, err := mountLV(ctx, snapLv, mountPath, vg, "", nil)
 	if err != nil {
 		mountOutput := string(cmdout)
 		if !strings.Contains(mountOutput, "already mounted") {
-			return string(cmdout), fmt.Errorf("unable to mount %s to %s err:%v output:%s", snapLv, mountPath, err, cmdout)
+			return string(cmdout), nil, fmt.Errorf("unable to mount %s to %s err:%v output:%s", snapLv, mountPath, err, cmdout)
 		}
 	}
 
@@ -99,30 +116,30 @@ func CreateS3Snapshot(vg string, lv string, snapshotName string, size uint64, s3
 	args = append(args, "--tag", fmt.Sprintf("snapshot=%s", snapshotName))
 	args = append(args, "--tag", fmt.Sprintf("volume=%s", lv))
 
-	out, err = execResticCmd(mountPath, s3, args...)
+	out, err = execResticCmd(ctx, mountPath, s3, args...)
 	klog.Infof("restic output: %s", out)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	//umount, rmdir and lvremove are handled by defer func above
-	return fmt.Sprintf("snapshot %s for volume %s successfully created", snapshotName, lv), nil
+	return fmt.Sprintf("snapshot %s for volume %s successfully created", snapshotName, lv), backupStats(out), nil
 }
 
 // RestoreS3Snapshot creates a new backup snapshot
-func RestoreS3Snapshot(vg string, lv string, snapshotName string, s3 S3Parameter) (string, error) {
-	if !s3SnapshotExists(snapshotName, s3) {
+func RestoreS3Snapshot(ctx context.Context, vg string, lv string, snapshotName string, s3 S3Parameter) (string, error) {
+	if !s3SnapshotExists(ctx, snapshotName, s3) {
 		return "", fmt.Errorf("Snapshot %s does not exist", snapshotName)
 	}
 
 	restorePath := "/tmp/restore/" + lv
-	output, err := mountLV(lv, restorePath, vg)
+	output, err := mountLV(ctx, lv, restorePath, vg, "", nil)
 	if err != nil {
 		return "", fmt.Errorf("unable to mount lv: %v output:%s", err, output)
 	}
 	klog.Infof("%s mounted at %s", lv, restorePath)
 
 	defer func() {
-		out, err := umountLV(restorePath)
+		out, err := umountLV(ctx, restorePath)
 		if err != nil {
 			klog.Errorf("unable to umount directory %s for snapshot:%s err:%v %s", restorePath, snapshotName, err, out)
 		}
@@ -132,7 +149,7 @@ func RestoreS3Snapshot(vg string, lv string, snapshotName string, s3 S3Parameter
 	args = append(args, "--tag", fmt.Sprintf("snapshot=%s", snapshotName))
 	args = append(args, "--target", ".")
 
-	out, err := execResticCmd(restorePath, s3, args...)
+	out, err := execResticCmd(ctx, restorePath, s3, args...)
 	klog.Infof("restic output: %s", out)
 	if err != nil {
 		return out, err
@@ -140,9 +157,9 @@ func RestoreS3Snapshot(vg string, lv string, snapshotName string, s3 S3Parameter
 	return fmt.Sprintf("snapshot %s successfully restored to %s", snapshotName, lv), nil
 }
 
-func DeleteS3Snapshot(snapshotName string, s3 S3Parameter) (string, error) {
+func DeleteS3Snapshot(ctx context.Context, snapshotName string, s3 S3Parameter) (string, error) {
 
-	snapshots, err := s3ListSnapshots(snapshotName, "", s3)
+	snapshots, err := s3ListSnapshots(ctx, snapshotName, "", s3)
 	if err != nil || len(snapshots) != 1 {
 		if err != nil {
 			return "", err
@@ -151,7 +168,7 @@ func DeleteS3Snapshot(snapshotName string, s3 S3Parameter) (string, error) {
 	args := []string{"forget"}
 	args = append(args, "-l", "0", "--prune", snapshots[0].ID)
 
-	out, err := execResticCmd("", s3, args...)
+	out, err := execResticCmd(ctx, "", s3, args...)
 	klog.Infof("restic output: %s", out)
 	if err != nil {
 		return out, err
@@ -160,11 +177,24 @@ func DeleteS3Snapshot(snapshotName string, s3 S3Parameter) (string, error) {
 
 }
 
-func s3SnapshotExists(snapshotName string, s3 S3Parameter) bool {
+// backupStats returns the stats of the summary in the json output of restic backup
+func backupStats(out string) *BackupStats {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var summary resticBackupSummary
+		if err := json.Unmarshal([]byte(lines[i]), &summary); err != nil || summary.MessageType != "summary" {
+			continue
+		}
+		return &BackupStats{Seconds: summary.TotalDuration, BytesAdded: summary.DataAdded}
+	}
+	return nil
+}
+
+func s3SnapshotExists(ctx context.Context, snapshotName string, s3 S3Parameter) bool {
 	args := []string{"snapshots"}
 	args = append(args, "--tag", fmt.Sprintf("snapshot=%s", snapshotName))
 
-	out, err := execResticCmd("", s3, args...)
+	out, err := execResticCmd(ctx, "", s3, args...)
 	if err != nil {
 		return false
 	}
@@ -174,7 +204,7 @@ func s3SnapshotExists(snapshotName string, s3 S3Parameter) bool {
 	return true
 }
 
-func s3ListSnapshots(snapshotName string, lv string, s3 S3Parameter) ([]s3Snapshot, error) {
+func s3ListSnapshots(ctx context.Context, snapshotName string, lv string, s3 S3Parameter) ([]s3Snapshot, error) {
 	args := []string{"snapshots"}
 
 	// filter for snapshotName and/or lv name
@@ -185,7 +215,7 @@ func s3ListSnapshots(snapshotName string, lv string, s3 S3Parameter) ([]s3Snapsh
 		args = append(args, "--tag", fmt.Sprintf("volume=%s", lv))
 	}
 
-	snapshotsOut, err := execResticCmd("", s3, args...)
+	snapshotsOut, err := execResticCmd(ctx, "", s3, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -199,7 +229,7 @@ func s3ListSnapshots(snapshotName string, lv string, s3 S3Parameter) ([]s3Snapsh
 
 	for _, rs := range rsl {
 		args = []string{"stats", rs.ShortID}
-		statsOut, err := execResticCmd("", s3, args...)
+		statsOut, err := execResticCmd(ctx, "", s3, args...)
 		if err != nil {
 			return nil, err
 		}
@@ -271,7 +301,7 @@ func secretsToS3Parameter(secrets map[string]string) (S3Parameter, error) {
 	}, nil
 }
 
-func execResticCmd(path string, s3 S3Parameter, args ...string) (string, error) {
+func execResticCmd(ctx context.Context, path string, s3 S3Parameter, args ...string) (string, error) {
 
 	args = append(args, "-r", fmt.Sprintf("s3:%s/%s", s3.Endpoint, s3.BucketName), "--json")
 	// restic init has no "--host"
@@ -291,7 +321,7 @@ func execResticCmd(path string, s3 S3Parameter, args ...string) (string, error)
 		fmt.Sprintf("%s=%s", "RESTIC_PASSWORD", s3.CryptKey))
 
 	klog.Infof("restic %s\n", args)
-	out, err := cmd.CombinedOutput()
+	out, err := runCommand(ctx, cmd)
 	return string(out), err
 }
 
@@ -0,0 +1,170 @@
+package lvm
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// selfCheckInterval in which the requirements of the plugin are checked again, probes return the last result
+const selfCheckInterval = 10 * time.Second
+
+// requiredBinaries are executed by the node server and the trimmer, mkfs for the supported filesystems
+var requiredBinaries = []string{"lvm", "blkid", "mount", "umount", "fsadm", "mkfs.ext4", "mkfs.xfs"}
+
+// checkResult is the outcome of a single requirement of the plugin
+type checkResult struct {
+	name   string
+	detail string
+	err    error
+	// external failures make the plugin unready but keep it alive, a restart of the plugin does not fix them
+	external bool
+}
+
+// selfCheck verifies the requirements of the plugin on this node: lvm and filesystem binaries, restic if snapshots
+// are executed by the agent, the volume group and the connection to the kubernetes api of the controller, which is
+// not checked without a kube client in ephemeral mode
+type selfCheck struct {
+	vgName         string
+	devicesPattern string
+	agent          bool
+	kubeClient     kubernetes.Interface
+
+	mu      sync.RWMutex
+	results []checkResult
+}
+
+func newSelfCheck(vgName string, devicesPattern string, agent bool, kubeClient kubernetes.Interface) *selfCheck {
+	return &selfCheck{
+		vgName:         vgName,
+		devicesPattern: devicesPattern,
+		agent:          agent,
+		kubeClient:     kubeClient,
+	}
+}
+
+// run checks the requirements once and logs the report, then keeps checking them in the background
+func (c *selfCheck) run() {
+	c.check()
+	c.report()
+	go func() {
+		for {
+			time.Sleep(selfCheckInterval)
+			c.check()
+		}
+	}()
+}
+
+func (c *selfCheck) check() {
+	binaries := requiredBinaries
+	if c.agent {
+		binaries = append(binaries[:len(binaries):len(binaries)], "restic")
+	}
+	var results []checkResult
+	for _, binary := range binaries {
+		path, err := exec.LookPath(binary)
+		results = append(results, checkResult{name: "binary " + binary, detail: path, err: err})
+	}
+	results = append(results, c.checkVG())
+	if c.kubeClient != nil {
+		results = append(results, c.checkKubernetes())
+	}
+
+	c.mu.Lock()
+	c.results = results
+	c.mu.Unlock()
+}
+
+// checkVG accepts a missing volume group if devices to create it are present, it is created with the first volume
+func (c *selfCheck) checkVG() checkResult {
+	result := checkResult{name: "volume group " + c.vgName}
+	vgexists, err := vgExists(c.vgName)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if vgexists {
+		vg, err := GetVG(c.vgName)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		result.detail = fmt.Sprintf("%d physical volumes, %d of %d bytes free", vg.PVCount, vg.Free, vg.Size)
+		return result
+	}
+	devs, err := devices(strings.Split(c.devicesPattern, ","))
+	if err != nil {
+		result.err = fmt.Errorf("unable to search devices %s: %v", c.devicesPattern, err)
+		return result
+	}
+	if len(devs) == 0 {
+		result.err = fmt.Errorf("volume group does not exist and no device matches %s", c.devicesPattern)
+		result.external = true
+		return result
+	}
+	result.detail = fmt.Sprintf("not created yet, devices: %s", strings.Join(devs, ","))
+	return result
+}
+
+func (c *selfCheck) checkKubernetes() checkResult {
+	result := checkResult{name: "kubernetes api"}
+	version, err := c.kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		result.err = fmt.Errorf("unable to connect: %v", err)
+		result.external = true
+		return result
+	}
+	result.detail = version.GitVersion
+	return result
+}
+
+// report logs the result of every check
+func (c *selfCheck) report() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, r := range c.results {
+		if r.err != nil {
+			klog.Errorf("self check %s: failed: %v", r.name, r.err)
+			continue
+		}
+		klog.Infof("self check %s: ok %s", r.name, r.detail)
+	}
+}
+
+// problems returns the failed checks, empty if the plugin is ready. The external failures are skipped for liveness.
+func (c *selfCheck) problems(liveness bool) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var problems []string
+	for _, r := range c.results {
+		if r.err == nil || (liveness && r.external) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s: %v", r.name, r.err))
+	}
+	return problems
+}
+
+// serveLiveness exposes /livez on address for the liveness probe of the plugin, it only fails on checks a restart
+// can fix, readiness is reported by the CSI Probe
+func (c *selfCheck) serveLiveness(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		if problems := c.problems(true); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	klog.Infof("serving liveness on %s/livez", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		klog.Errorf("unable to serve liveness: %v", err)
+	}
+}
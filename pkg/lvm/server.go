@@ -22,9 +22,12 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -77,7 +80,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(traceGRPC, logGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -109,7 +112,9 @@ func parseEndpoint(ep string) (string, string, error) {
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
 	klog.V(5).Infof("GRPC request: %+v", protosanitizer.StripSecrets(req))
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	grpcRequestDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
 	if err != nil {
 		klog.Errorf("GRPC error: %v", err)
 	} else {
@@ -117,3 +122,13 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+var tracedGRPC = otelgrpc.UnaryServerInterceptor()
+
+// traceGRPC creates spans of the CSI calls, the identity calls of the liveness probe are not traced
+func traceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, "/csi.v1.Identity/") {
+		return handler(ctx, req)
+	}
+	return tracedGRPC(ctx, req, info, handler)
+}
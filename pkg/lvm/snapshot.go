@@ -0,0 +1,125 @@
+package lvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	snapshotBackendS3    = "s3"
+	snapshotBackendLocal = "local"
+
+	// localSnapshotTag marks snapshots which are kept on the node
+	localSnapshotTag = "lv.metal-stack.io/csi-lvm-snapshot"
+	// lvm: Names starting "snapshot" are reserved.
+	localSnapshotPrefix   = "snap-"
+	localSnapshotIDPrefix = snapshotBackendLocal + "/"
+)
+
+// ErrVolumeHasSnapshots is returned if a volume with local snapshots is deleted, lvm would remove the copy on write
+// snapshots together with the volume
+var ErrVolumeHasSnapshots = errors.New("volume has local snapshots")
+
+// localSnapshotsOf returns the names of the local snapshots of the logical volume name
+func localSnapshotsOf(lvs []LogicalVolume, name string) []string {
+	var snapshots []string
+	for _, lv := range lvs {
+		if lv.hasTag(localSnapshotTag) && lv.Origin == name {
+			snapshots = append(snapshots, lv.Name)
+		}
+	}
+	return snapshots
+}
+
+// checkNoLocalSnapshots returns ErrVolumeHasSnapshots if the logical volume is the origin of local snapshots
+func checkNoLocalSnapshots(vg string, name string) error {
+	lvs, err := ListLVs(vg)
+	if err != nil {
+		return err
+	}
+	if snapshots := localSnapshotsOf(lvs, name); len(snapshots) > 0 {
+		return fmt.Errorf("logical volume %s is the origin of %s: %w", name, strings.Join(snapshots, ","), ErrVolumeHasSnapshots)
+	}
+	return nil
+}
+
+// localSnapshot identifies a snapshot logical volume on a node
+type localSnapshot struct {
+	node   string
+	vgName string
+	lvName string
+}
+
+func localSnapshotLVName(snapshotName string) string {
+	return localSnapshotPrefix + snapshotName
+}
+
+// name returns the name of the snapshot requested by CreateSnapshot
+func (s localSnapshot) name() string {
+	return strings.TrimPrefix(s.lvName, localSnapshotPrefix)
+}
+
+// id returns the snapshot id in the form local/<node>/<vg>/<lv>
+func (s localSnapshot) id() string {
+	return localSnapshotIDPrefix + volumeID{node: s.node, vgName: s.vgName, lvName: s.lvName}.String()
+}
+
+func isLocalSnapshotID(id string) bool {
+	return strings.HasPrefix(id, localSnapshotIDPrefix)
+}
+
+func parseLocalSnapshotID(id string) (*localSnapshot, error) {
+	v, err := parseVolumeID(strings.TrimPrefix(id, localSnapshotIDPrefix))
+	if !isLocalSnapshotID(id) || err != nil || v.isLegacy() {
+		return nil, fmt.Errorf("invalid local snapshot id %s", id)
+	}
+	return &localSnapshot{node: v.node, vgName: v.vgName, lvName: v.lvName}, nil
+}
+
+// CreateLocalSnapshot creates a lvm snapshot which is kept on the node.
+// Thin volumes get a thin snapshot, all other volumes a copy on write snapshot
+// with lvmSnapshotBufferPercentage of the volume size reserved for changes.
+func CreateLocalSnapshot(ctx context.Context, vg string, lv string, snapshotName string, lvmSnapshotBufferPercentage int) (string, error) {
+	origin, err := getLV(vg, lv)
+	if err != nil {
+		return "", err
+	}
+	if origin.isMerging() {
+		return "", fmt.Errorf("logical volume %s: %w", lv, ErrVolumeMerging)
+	}
+
+	snapLv := localSnapshotLVName(snapshotName)
+	exists, err := lvExists(vg, snapLv)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		existing, err := getLV(vg, snapLv)
+		if err != nil {
+			return "", err
+		}
+		if existing.Origin != lv {
+			return "", fmt.Errorf("logical volume %s already exists with origin %s", snapLv, existing.Origin)
+		}
+		klog.Infof("snapshot %s of %s already exists", snapLv, lv)
+		return snapLv, nil
+	}
+
+	args := []string{"-q", "-s", "-n", snapLv, "--add-tag", localSnapshotTag}
+	if !origin.isThin() {
+		size := float64(origin.Size) * float64(lvmSnapshotBufferPercentage) / 100
+		args = append(args, "-L", fmt.Sprintf("%ds", int64(size/512)+10000))
+	}
+	args = append(args, fmt.Sprintf("%s/%s", vg, lv))
+
+	klog.Infof("lvcreate %s", args)
+	out, err := lvmCommand(ctx, "lvcreate", args...)
+	if err != nil {
+		return string(out), err
+	}
+	return fmt.Sprintf("snapshot %s for volume %s successfully created", snapLv, lv), nil
+}
@@ -0,0 +1,132 @@
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// TerminationLogPath is the termination message path of the provisioner container
+	TerminationLogPath = "/termination.log"
+
+	// maxTerminationMessageLength is the limit of kubernetes for termination messages
+	maxTerminationMessageLength = 4096
+)
+
+// ProvisionerError is written by the provisioner to its termination log, the controller returns it as grpc status
+type ProvisionerError struct {
+	// Code is the name of the grpc code, e.g. ResourceExhausted
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Output of the failed lvm or restic command
+	Output string `json:"output,omitempty"`
+}
+
+// NewProvisionerError returns a provisioner error with the output of the failed command
+func NewProvisionerError(code codes.Code, output string, format string, args ...interface{}) *ProvisionerError {
+	return &ProvisionerError{
+		Code:    code.String(),
+		Message: fmt.Sprintf(format, args...),
+		Output:  strings.TrimSpace(output),
+	}
+}
+
+func (e *ProvisionerError) Error() string {
+	if e.Output == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s output:%s", e.Message, e.Output)
+}
+
+// GRPCStatus returns the error as grpc status
+func (e *ProvisionerError) GRPCStatus() *status.Status {
+	code := codes.ResourceExhausted
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if c.String() == e.Code {
+			code = c
+			break
+		}
+	}
+	return status.New(code, e.Error())
+}
+
+// LVMErrorCode returns the grpc code of a failed lvm command on an existing volume. Failures are ResourceExhausted by
+// default. It must not be used for failures to create or clone a volume, which are always ResourceExhausted to let the
+// external-provisioner reschedule the volume to another node.
+func LVMErrorCode(output string) codes.Code {
+	lower := strings.ToLower(output)
+	switch {
+	case strings.Contains(lower, "not found") || strings.Contains(lower, "failed to find"):
+		return codes.NotFound
+	case strings.Contains(lower, "already exists"):
+		return codes.AlreadyExists
+	case strings.Contains(lower, "in use") || strings.Contains(lower, "is open"):
+		return codes.FailedPrecondition
+	}
+	return codes.ResourceExhausted
+}
+
+// WriteTerminationMessage writes the error to the termination log at path, errors which are no provisioner errors are
+// invalid arguments of the provisioner
+func WriteTerminationMessage(path string, err error) error {
+	pe, ok := err.(*ProvisionerError)
+	if !ok {
+		pe = NewProvisionerError(codes.InvalidArgument, "", "%v", err)
+	}
+	data, err := json.Marshal(pe)
+	if err != nil {
+		return err
+	}
+	// keep the end of the output, the error is usually reported last
+	truncated := *pe
+	for len(data) > maxTerminationMessageLength && truncated.Output != "" {
+		cut := len(data) - maxTerminationMessageLength + len("...")
+		if cut >= len(truncated.Output) {
+			truncated.Output = ""
+		} else {
+			truncated.Output = "..." + truncated.Output[cut:]
+		}
+		data, err = json.Marshal(truncated)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ProvisionerResult is written by the provisioner to its termination log on success
+type ProvisionerResult struct {
+	Backup *BackupStats `json:"backup,omitempty"`
+}
+
+// WriteTerminationResult writes the result of a successful provisioner command to the termination log at path
+func WriteTerminationResult(path string, result *ProvisionerResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// readTerminationResult parses the termination message of a successful provisioner, nil if it is none
+func readTerminationResult(message string) *ProvisionerResult {
+	result := &ProvisionerResult{}
+	if err := json.Unmarshal([]byte(message), result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// readTerminationMessage parses the termination message of a provisioner, nil if it is none
+func readTerminationMessage(message string) *ProvisionerError {
+	pe := &ProvisionerError{}
+	if err := json.Unmarshal([]byte(message), pe); err != nil || pe.Code == "" {
+		return nil
+	}
+	return pe
+}
@@ -0,0 +1,161 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	tracerName = "github.com/metal-stack/csi-driver-lvm"
+
+	// TracingEndpointEnv passes the OTLP endpoint of the controller to the provisioner
+	TracingEndpointEnv = "CSI_LVM_OTLP_ENDPOINT"
+)
+
+// tracingEndpoint is passed to the provisioner, empty if tracing is disabled
+var tracingEndpoint string
+
+// tracer returns the tracer of the current provider, it creates no spans until tracing is started
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// StartTracing exports the spans of service with OTLP over gRPC to endpoint, e.g. otel-collector:4317, tracing is
+// disabled if endpoint is empty. The returned function flushes the remaining spans.
+func StartTracing(ctx context.Context, endpoint string, service string) (func(), error) {
+	if endpoint == "" {
+		return func() {}, nil
+	}
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create otlp exporter for %s: %v", endpoint, err)
+	}
+	tracingEndpoint = endpoint
+	klog.Infof("exporting traces to %s", endpoint)
+	provider := startTracing(sdktrace.WithBatcher(exporter), service)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			klog.Errorf("unable to flush spans: %v", err)
+		}
+	}, nil
+}
+
+// StartTracingWithExporter exports the spans of service synchronously to exporter, e.g. the in-memory exporter of
+// go.opentelemetry.io/otel/sdk/trace/tracetest in tests
+func StartTracingWithExporter(exporter sdktrace.SpanExporter, service string) *sdktrace.TracerProvider {
+	return startTracing(sdktrace.WithSyncer(exporter), service)
+}
+
+func startTracing(processor sdktrace.TracerProviderOption, service string) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider
+}
+
+// envCarrier holds the trace context as environment variables of the provisioner
+type envCarrier map[string]string
+
+func (c envCarrier) Get(key string) string {
+	return c[strings.ToUpper(key)]
+}
+
+func (c envCarrier) Set(key string, value string) {
+	c[strings.ToUpper(key)] = value
+}
+
+func (c envCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// traceEnv returns the environment which continues the trace of ctx in the provisioner
+func traceEnv(ctx context.Context) []v1.EnvVar {
+	if tracingEndpoint == "" {
+		return nil
+	}
+	carrier := envCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	env := []v1.EnvVar{{Name: TracingEndpointEnv, Value: tracingEndpoint}}
+	for _, key := range carrier.Keys() {
+		env = append(env, v1.EnvVar{Name: key, Value: carrier[key]})
+	}
+	return env
+}
+
+// ContextFromEnvironment returns ctx with the trace of the controller passed to the provisioner
+func ContextFromEnvironment(ctx context.Context) context.Context {
+	carrier := envCarrier{}
+	for _, key := range otel.GetTextMapPropagator().Fields() {
+		if value := os.Getenv(strings.ToUpper(key)); value != "" {
+			carrier.Set(key, value)
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// StartProvisionerSpan starts tracing if the controller passed its endpoint and continues the trace of the controller
+// in a span of the provisioner command. The returned function ends the span with the result of the command and
+// flushes it. Arguments are not recorded, they contain the s3 credentials.
+func StartProvisionerSpan(ctx context.Context, command string) (context.Context, func(error)) {
+	stop, err := StartTracing(ctx, os.Getenv(TracingEndpointEnv), "csi-lvmplugin-provisioner")
+	if err != nil {
+		klog.Errorf("unable to start tracing: %v", err)
+		return ctx, func(error) {}
+	}
+	ctx, span := tracer().Start(ContextFromEnvironment(ctx), "provisioner "+command)
+	var once sync.Once
+	return ctx, func(err error) {
+		once.Do(func() {
+			setSpanError(span, err)
+			span.End()
+			stop()
+		})
+	}
+}
+
+// runCommand runs cmd in a span and returns its combined output. Only the command name is recorded, the arguments may
+// contain secrets like the s3 parameters of the provisioner.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	_, span := tracer().Start(ctx, "exec "+cmd.Args[0])
+	defer span.End()
+	out, err := cmd.CombinedOutput()
+	setSpanError(span, err)
+	return out, err
+}
+
+// setSpanError marks the span as failed if err is not nil
+func setSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(otelcodes.Error, err.Error())
+}
@@ -0,0 +1,187 @@
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeJobAPI records the provisioner jobs created on the kubernetes api and rejects them
+func fakeJobAPI(t *testing.T) (*httptest.Server, chan batchv1.Job) {
+	t.Helper()
+	jobs := make(chan batchv1.Job, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job batchv1.Job
+		if r.Method == http.MethodPost && json.NewDecoder(r.Body).Decode(&job) == nil {
+			select {
+			case jobs <- job:
+			default:
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonForbidden,
+			Code:     http.StatusForbidden,
+		})
+	}))
+	return server, jobs
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("no span %q in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := StartTracingWithExporter(exporter, "csi-lvmplugin")
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+	tracingEndpoint = "otel-collector:4317"
+	defer func() { tracingEndpoint = "" }()
+
+	server, jobs := fakeJobAPI(t)
+	defer server.Close()
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("unable to create kube client: %v", err)
+	}
+
+	cs := &controllerServer{queue: newNodeQueue(1)}
+	va := volumeAction{
+		action:           actionTypeCreate,
+		name:             "pvc-1",
+		nodeName:         "node-1",
+		size:             1 << 20,
+		lvmType:          linearType,
+		devicesPattern:   "/dev/loop*",
+		provisionerImage: "metalstack/csi-lvmplugin-provisioner",
+		kubeClient:       *kubeClient,
+		namespace:        "csi-lvm",
+		vgName:           "csi-lvm",
+	}
+
+	// the identity calls of the liveness-probe sidecar are not traced
+	_, err = traceGRPC(context.Background(), &csi.ProbeRequest{}, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Identity/Probe"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.ProbeResponse{}, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected probe error: %v", err)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("identity call traced: %v", spans)
+	}
+
+	_, err = traceGRPC(context.Background(), &csi.CreateVolumeRequest{}, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, err := runCommand(ctx, exec.Command("true", "--s3parameter", "secret")); err != nil {
+			t.Errorf("unable to run true: %v", err)
+		}
+		return nil, cs.runVolumeAction(ctx, va, 10)
+	})
+	if err == nil {
+		t.Fatalf("expected the forbidden job to fail the call")
+	}
+
+	spans := exporter.GetSpans()
+	var serverSpan tracetest.SpanStub
+	for _, span := range spans {
+		if span.SpanKind == trace.SpanKindServer {
+			serverSpan = span
+		}
+	}
+	if !strings.HasSuffix(serverSpan.Name, "Controller/CreateVolume") {
+		t.Fatalf("no server span of CreateVolume in %v", spans)
+	}
+	actionSpan := findSpan(t, spans, "volume action create")
+	jobSpan := findSpan(t, spans, "provisioner job create")
+	execSpan := findSpan(t, spans, "exec true")
+
+	if actionSpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("volume action span is not a child of the server span")
+	}
+	if jobSpan.Parent.SpanID() != actionSpan.SpanContext.SpanID() {
+		t.Errorf("provisioner job span is not a child of the volume action span")
+	}
+	if jobSpan.Status.Code != otelcodes.Error || actionSpan.Status.Code != otelcodes.Error {
+		t.Errorf("failed job not recorded, job status:%v action status:%v", jobSpan.Status, actionSpan.Status)
+	}
+	if execSpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("exec span is not a child of the server span")
+	}
+	// the arguments of commands may contain s3 credentials
+	if len(execSpan.Attributes) != 0 {
+		t.Errorf("exec span has attributes: %v", execSpan.Attributes)
+	}
+
+	var job batchv1.Job
+	select {
+	case job = <-jobs:
+	default:
+		t.Fatalf("no provisioner job created")
+	}
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env[TracingEndpointEnv] != tracingEndpoint {
+		t.Errorf("job env %s=%q, want %q", TracingEndpointEnv, env[TracingEndpointEnv], tracingEndpoint)
+	}
+	assertTraceRoundTrip(t, exporter, job.Spec.Template.Spec.Containers[0].Env, jobSpan)
+}
+
+// assertTraceRoundTrip continues the trace with the environment of the job like the provisioner does and checks
+// that the provisioner span is a child of the job span
+func assertTraceRoundTrip(t *testing.T, exporter *tracetest.InMemoryExporter, env []v1.EnvVar, jobSpan tracetest.SpanStub) {
+	t.Helper()
+	for _, e := range env {
+		if err := os.Setenv(e.Name, e.Value); err != nil {
+			t.Fatalf("unable to set %s: %v", e.Name, err)
+		}
+		defer os.Unsetenv(e.Name)
+	}
+	if os.Getenv("TRACEPARENT") == "" {
+		t.Fatalf("no traceparent in the job env %v", env)
+	}
+
+	ctx := ContextFromEnvironment(context.Background())
+	parent := trace.SpanContextFromContext(ctx)
+	if !parent.IsRemote() || parent.TraceID() != jobSpan.SpanContext.TraceID() || parent.SpanID() != jobSpan.SpanContext.SpanID() {
+		t.Fatalf("context from environment %v, want the job span %v", parent, jobSpan.SpanContext)
+	}
+
+	exporter.Reset()
+	_, span := tracer().Start(ctx, "provisioner createlv")
+	span.End()
+	provisionerSpan := findSpan(t, exporter.GetSpans(), "provisioner createlv")
+	if provisionerSpan.SpanContext.TraceID() != jobSpan.SpanContext.TraceID() || provisionerSpan.Parent.SpanID() != jobSpan.SpanContext.SpanID() {
+		t.Errorf("provisioner span does not continue the trace of the job span")
+	}
+}
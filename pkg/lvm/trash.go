@@ -0,0 +1,306 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// trashedTag marks logical volumes of deleted volumes kept for the trash retention period
+	trashedTag = "lv.metal-stack.io/csi-lvm-trashed"
+	// deletedAtTagPrefix is followed by the unix time of the deletion
+	deletedAtTagPrefix = "lv.metal-stack.io/csi-lvm-deleted-at="
+	trashPrefix        = "trash-"
+
+	// undeleteAnnotation on a persistent volume requests the restore of its trashed logical volume
+	undeleteAnnotation = "csi-lvm.metal-stack.io/undelete"
+)
+
+// TrashedVolume is the logical volume of a deleted volume in the trash
+type TrashedVolume struct {
+	// Name of the deleted volume
+	Name      string
+	LV        LogicalVolume
+	DeletedAt time.Time
+}
+
+// NodeTrashedVolumes returns the trashed volumes of a node as published by the node plugin running there, oldest first
+func NodeTrashedVolumes(kubeClient kubernetes.Clientset, namespace string, node string) ([]TrashedVolume, error) {
+	inv, err := getInventory(kubeClient, namespace, node)
+	if err != nil {
+		return nil, err
+	}
+	var trashed []TrashedVolume
+	for _, lv := range trashedLVs(inv.LVs) {
+		trashed = append(trashed, TrashedVolume{
+			Name:      strings.TrimPrefix(lv.Name, trashPrefix),
+			LV:        lv,
+			DeletedAt: lv.deletedAt(),
+		})
+	}
+	return trashed, nil
+}
+
+// TrashName returns the name of the logical volume of a deleted volume in the trash
+func TrashName(lvName string) string {
+	return trashPrefix + lvName
+}
+
+// DeleteLV removes the logical volume, with a retention it is moved to the trash instead
+func DeleteLV(ctx context.Context, vg string, name string, retention time.Duration) (string, error) {
+	if err := checkNotMerging(vg, name); err != nil {
+		return "", err
+	}
+	if err := checkNoLocalSnapshots(vg, name); err != nil {
+		return "", err
+	}
+	if retention <= 0 {
+		return RemoveLVS(ctx, vg, name)
+	}
+	return TrashLV(ctx, vg, name)
+}
+
+// TrashLV renames the logical volume and tags it with the deletion time, it is removed after the retention period
+// or if the space is needed for new volumes. A previously trashed volume of the same name is replaced.
+func TrashLV(ctx context.Context, vg string, name string) (string, error) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return fmt.Sprintf("logical volume %s not found in volumegroup %s.", name, vg), nil
+	}
+	lv, err := getLV(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if lv.isOpen() {
+		return "", fmt.Errorf("logical volume %s is in use", name)
+	}
+	trashName := TrashName(name)
+	exists, err = lvExists(vg, trashName)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		out, err := RemoveLVS(ctx, vg, trashName)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	args := []string{fmt.Sprintf("%s/%s", vg, name), trashName}
+	klog.Infof("lvrename %s", args)
+	out, err := lvmCommand(ctx, "lvrename", args...)
+	if err != nil {
+		return string(out), err
+	}
+	// an inactive volume can not be mounted by accident
+	args = []string{"-an", "--addtag", trashedTag, "--addtag", fmt.Sprintf("%s%d", deletedAtTagPrefix, time.Now().Unix()), fmt.Sprintf("%s/%s", vg, trashName)}
+	klog.Infof("lvchange %s", args)
+	out, err = lvmCommand(ctx, "lvchange", args...)
+	return string(out), err
+}
+
+// RestoreLV moves the logical volume of a deleted volume out of the trash
+func RestoreLV(ctx context.Context, vg string, name string) (string, error) {
+	exists, err := lvExists(vg, name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("logical volume %s already exists", name)
+	}
+	trashName := TrashName(name)
+	lv, err := getLV(vg, trashName)
+	if err != nil {
+		return "", err
+	}
+	if !lv.isTrashed() {
+		return "", fmt.Errorf("logical volume %s is not trashed", trashName)
+	}
+
+	args := []string{"--deltag", trashedTag}
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, deletedAtTagPrefix) {
+			args = append(args, "--deltag", tag)
+		}
+	}
+	args = append(args, fmt.Sprintf("%s/%s", vg, trashName))
+	klog.Infof("lvchange %s", args)
+	out, err := lvmCommand(ctx, "lvchange", args...)
+	if err != nil {
+		return string(out), err
+	}
+	args = []string{fmt.Sprintf("%s/%s", vg, trashName), name}
+	klog.Infof("lvrename %s", args)
+	out, err = lvmCommand(ctx, "lvrename", args...)
+	return string(out), err
+}
+
+// ReclaimTrash removes trashed logical volumes, oldest first, until a volume of the given size and type fits into the volume group.
+// Trashed volumes with a wipe policy are not reclaimed, wiping them could exceed the timeout of the volume creation;
+// they are removed after the retention period.
+func ReclaimTrash(vg string, size int64, lvmType string) error {
+	if exists, err := vgExists(vg); err != nil || !exists {
+		return err
+	}
+	required := size
+	if lvmType == mirrorType {
+		required = 2 * size
+	}
+	v, err := GetVG(vg)
+	if err != nil {
+		return err
+	}
+	if v.Free >= required {
+		return nil
+	}
+	lvs, err := ListLVs(vg)
+	if err != nil {
+		return err
+	}
+	free := v.Free
+	for _, lv := range reclaimableLVs(lvs) {
+		if free >= required {
+			break
+		}
+		out, err := RemoveLVS(context.Background(), vg, lv.Name)
+		if err != nil {
+			return fmt.Errorf("unable to remove trashed logical volume %s: %v output:%s", lv.Name, err, out)
+		}
+		klog.Infof("trashed logical volume %s deleted at %s removed to reclaim space", lv.Name, lv.deletedAt())
+		free += lv.Size
+	}
+	return nil
+}
+
+// purgeTrash removes the trashed logical volumes older than the retention period
+func purgeTrash(vg string, retention time.Duration) error {
+	if exists, err := vgExists(vg); err != nil || !exists {
+		return err
+	}
+	lvs, err := ListLVs(vg)
+	if err != nil {
+		return err
+	}
+	for _, lv := range trashedLVs(lvs) {
+		if time.Since(lv.deletedAt()) < retention {
+			continue
+		}
+		var out string
+		withNodeSlot(func() {
+			out, err = RemoveLVS(context.Background(), vg, lv.Name)
+		})
+		if err != nil {
+			klog.Errorf("unable to remove trashed logical volume %s: %v output:%s", lv.Name, err, out)
+			continue
+		}
+		klog.Infof("trashed logical volume %s deleted at %s removed after retention period", lv.Name, lv.deletedAt())
+	}
+	return nil
+}
+
+// trashedLVs returns the trashed logical volumes, oldest first
+func trashedLVs(lvs []LogicalVolume) []LogicalVolume {
+	var trashed []LogicalVolume
+	for _, lv := range lvs {
+		if lv.isTrashed() {
+			trashed = append(trashed, lv)
+		}
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].deletedAt().Before(trashed[j].deletedAt()) })
+	return trashed
+}
+
+// reclaimableLVs returns the trashed logical volumes without wipe policy, oldest first
+func reclaimableLVs(lvs []LogicalVolume) []LogicalVolume {
+	var reclaimable []LogicalVolume
+	for _, lv := range trashedLVs(lvs) {
+		if lv.wipePolicy() == wipeNone {
+			reclaimable = append(reclaimable, lv)
+		}
+	}
+	return reclaimable
+}
+
+func (lv LogicalVolume) isTrashed() bool {
+	return lv.hasTag(trashedTag)
+}
+
+// deletedAt returns the time the logical volume was moved to the trash
+func (lv LogicalVolume) deletedAt() time.Time {
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, deletedAtTagPrefix) {
+			unix, err := strconv.ParseInt(strings.TrimPrefix(tag, deletedAtTagPrefix), 10, 64)
+			if err == nil {
+				return time.Unix(unix, 0)
+			}
+		}
+	}
+	return lv.CreationTime
+}
+
+// runTrash restores the trashed volumes requested by undelete and purges the expired ones every interval seconds
+func (cs *controllerServer) runTrash(interval int, retention time.Duration) {
+	for {
+		pvs, err := cs.pvs.list()
+		if err != nil {
+			klog.Errorf("unable to list persistent volumes: %v", err)
+		} else {
+			for _, pv := range pvs {
+				if _, ok := pv.Annotations[undeleteAnnotation]; !ok || pv.Spec.CSI == nil {
+					continue
+				}
+				volID, err := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+				if err != nil || volID.node != cs.nodeID || volID.vgName != cs.vgName {
+					continue
+				}
+				cs.undelete(pv, volID.lvName)
+			}
+		}
+		// restored volumes are gone from the trash before it is purged, without retention the trash is emptied
+		if err := purgeTrash(cs.vgName, retention); err != nil {
+			klog.Errorf("unable to purge trashed logical volumes: %v", err)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// undelete restores the trashed logical volume of the persistent volume and removes the request annotation
+func (cs *controllerServer) undelete(pv *v1.PersistentVolume, lvName string) {
+	exists, err := lvExists(cs.vgName, lvName)
+	if err != nil {
+		klog.Errorf("unable to check logical volume %s of persistent volume %s: %v", lvName, pv.Name, err)
+		return
+	}
+	if !exists {
+		out, err := RestoreLV(context.Background(), cs.vgName, lvName)
+		if err != nil {
+			// the request stays, the volume can not be published anyway
+			klog.Errorf("unable to restore logical volume %s of persistent volume %s: %v output:%s", lvName, pv.Name, err, out)
+			return
+		}
+		klog.Infof("logical volume %s of persistent volume %s restored from trash", lvName, pv.Name)
+	}
+
+	current, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("unable to read persistent volume %s: %v", pv.Name, err)
+		return
+	}
+	delete(current.Annotations, undeleteAnnotation)
+	_, err = cs.kubeClient.CoreV1().PersistentVolumes().Update(context.Background(), current, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Errorf("unable to update persistent volume %s: %v", pv.Name, err)
+	}
+}
@@ -0,0 +1,204 @@
+package lvm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// trimIntervalParameter in the storage class overrides the trim interval of the node plugin, 0 disables it
+	trimIntervalParameter = "trimInterval"
+	// discardParameter in the storage class mounts the filesystem with the discard option instead
+	discardParameter = "discard"
+
+	// trimIntervalTagPrefix is followed by the trim interval of the volume, the trimmer does not know the volume context
+	trimIntervalTagPrefix = "lv.metal-stack.io/csi-lvm-trim-interval="
+
+	trimCheckInterval = time.Minute
+)
+
+var trimmedBytesPattern = regexp.MustCompile(`(\d+) bytes`)
+
+// validateTrimParameters checks the trim parameters of a storage class or volume context
+func validateTrimParameters(params map[string]string) error {
+	if interval := params[trimIntervalParameter]; interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %s, must be a duration like 24h", trimIntervalParameter, interval)
+		}
+	}
+	if discard := params[discardParameter]; discard != "" {
+		if _, err := strconv.ParseBool(discard); err != nil {
+			return fmt.Errorf("invalid %s %s, must be true or false", discardParameter, discard)
+		}
+	}
+	return nil
+}
+
+// mountDiscard returns true if the filesystem should be mounted with online discard
+func mountDiscard(params map[string]string) bool {
+	discard, _ := strconv.ParseBool(params[discardParameter])
+	return discard
+}
+
+// setTrimInterval stores the trim interval of the volume context as tag on the logical volume
+func setTrimInterval(ctx context.Context, vg string, lv *LogicalVolume, interval string) (string, error) {
+	if interval == "" {
+		return "", nil
+	}
+	tag := trimIntervalTagPrefix + interval
+	if lv.hasTag(tag) {
+		return "", nil
+	}
+	args := []string{"--addtag", tag}
+	for _, t := range lv.Tags {
+		if strings.HasPrefix(t, trimIntervalTagPrefix) {
+			args = append(args, "--deltag", t)
+		}
+	}
+	args = append(args, fmt.Sprintf("%s/%s", vg, lv.Name))
+	klog.Infof("lvchange %s", args)
+	out, err := lvmCommand(ctx, "lvchange", args...)
+	return string(out), err
+}
+
+// trimInterval returns the trim interval of the logical volume, or the given default if the volume has none
+func (lv LogicalVolume) trimInterval(defaultInterval time.Duration) time.Duration {
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, trimIntervalTagPrefix) {
+			d, err := time.ParseDuration(strings.TrimPrefix(tag, trimIntervalTagPrefix))
+			if err == nil {
+				return d
+			}
+		}
+	}
+	return defaultInterval
+}
+
+// trimmer periodically runs fstrim on the mounted filesystem volumes of this node, freed blocks are released to
+// the ssd or thin pool.
+type trimmer struct {
+	nodeID          string
+	vgName          string
+	pvs             *pvCache
+	defaultInterval time.Duration
+	// lastTrim is the time of the last trim of a logical volume, volumes are trimmed after a restart first
+	lastTrim map[string]time.Time
+}
+
+func newTrimmer(nodeID string, vgName string, pvs *pvCache, defaultInterval time.Duration) *trimmer {
+	return &trimmer{
+		nodeID:          nodeID,
+		vgName:          vgName,
+		pvs:             pvs,
+		defaultInterval: defaultInterval,
+		lastTrim:        map[string]time.Time{},
+	}
+}
+
+func (t *trimmer) run() {
+	for {
+		time.Sleep(trimCheckInterval)
+		err := t.trim()
+		if err != nil {
+			klog.Errorf("unable to trim volumes: %v", err)
+		}
+	}
+}
+
+func (t *trimmer) trim() error {
+	if exists, err := vgExists(t.vgName); err != nil || !exists {
+		return err
+	}
+	lvs, err := ListLVs(t.vgName)
+	if err != nil {
+		return err
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	trimmed := map[string]bool{}
+	for _, lv := range lvs {
+		if !lv.hasTag(lvmDriverTag) || !lv.isOpen() {
+			continue
+		}
+		interval := lv.trimInterval(t.defaultInterval)
+		if interval <= 0 {
+			continue
+		}
+		// block volumes are bind mounts of the device node, they have no filesystem mount
+		target := mounts[devicePath(lvPath(t.vgName, lv.Name))]
+		if target == "" {
+			continue
+		}
+		trimmed[lv.Name] = true
+		if time.Since(t.lastTrim[lv.Name]) < interval {
+			continue
+		}
+
+		klog.Infof("fstrim -v %s", target)
+		out, err := runCommand(context.Background(), exec.Command("fstrim", "-v", target))
+		t.lastTrim[lv.Name] = time.Now()
+		if err != nil {
+			klog.Errorf("unable to trim volume %s: %v output:%s", lv.Name, err, out)
+			continue
+		}
+		if m := trimmedBytesPattern.FindStringSubmatch(string(out)); m != nil {
+			bytes, _ := strconv.ParseFloat(m[1], 64)
+			// the same volume label as the i/o statistics
+			trimmedBytes.WithLabelValues(t.nodeID, volumeLabel(volumeHandles(t.pvs, t.nodeID, t.vgName), t.nodeID, t.vgName, lv.Name)).Add(bytes)
+			klog.Infof("volume %s trimmed, %s bytes released", lv.Name, m[1])
+		}
+	}
+
+	for name := range t.lastTrim {
+		if !trimmed[name] {
+			delete(t.lastTrim, name)
+		}
+	}
+	return nil
+}
+
+// mountPoints returns one mount point of every mounted device, keyed by the resolved device path
+func mountPoints() (map[string]string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		device := devicePath(fields[0])
+		if _, ok := mounts[device]; !ok {
+			mounts[device] = fields[1]
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// devicePath resolves the symlinks of /dev/<vg>/<lv> and /dev/mapper/<vg>-<lv> to the device mapper device
+func devicePath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
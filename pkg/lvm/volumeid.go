@@ -0,0 +1,103 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8serror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// volumeID identifies the logical volume of a volume, it is encoded as <node>/<vg>/<lv>.
+// Volumes created by older versions of the driver have the plain lv name as id,
+// node and volume group are unknown for them.
+type volumeID struct {
+	node   string
+	vgName string
+	lvName string
+}
+
+func (v volumeID) String() string {
+	if v.isLegacy() {
+		return v.lvName
+	}
+	return strings.Join([]string{v.node, v.vgName, v.lvName}, "/")
+}
+
+// isLegacy returns true for plain volume ids without node and volume group
+func (v volumeID) isLegacy() bool {
+	return v.node == "" || v.vgName == ""
+}
+
+// matches returns true if the logical volume lv on node is the volume with this id
+func (v volumeID) matches(node string, lv LogicalVolume) bool {
+	if v.isLegacy() {
+		return lv.Name == v.lvName
+	}
+	return v.node == node && v.vgName == lv.VGName && v.lvName == lv.Name
+}
+
+func parseVolumeID(id string) (*volumeID, error) {
+	parts := strings.Split(id, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return &volumeID{lvName: parts[0]}, nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+		return &volumeID{node: parts[0], vgName: parts[1], lvName: parts[2]}, nil
+	}
+	return nil, fmt.Errorf("invalid volume id %s", id)
+}
+
+// volumeID parses the id of a volume on this node, legacy ids are completed with the node and volume group of this node plugin
+func (ns *nodeServer) volumeID(id string) (*volumeID, error) {
+	v, err := parseVolumeID(id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if v.isLegacy() {
+		v.node = ns.nodeID
+		v.vgName = ns.vgName
+	}
+	if v.node != ns.nodeID {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is not located on node %s", id, ns.nodeID)
+	}
+	return v, nil
+}
+
+// resolveVolumeID parses a volume id, node and volume group of legacy ids are taken from the persistent volume
+// or the lvm inventories. A volume which can not be found returns a NotFound error.
+func (cs *controllerServer) resolveVolumeID(id string) (*volumeID, error) {
+	v, err := parseVolumeID(id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !v.isLegacy() {
+		return v, nil
+	}
+
+	// persistent volumes of legacy volumes are named like the logical volume
+	pv, err := cs.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), v.lvName, metav1.GetOptions{})
+	if err != nil && !k8serror.IsNotFound(err) {
+		return nil, status.Errorf(codes.Internal, "unable to read persistent volume %s: %v", v.lvName, err)
+	}
+	if err == nil {
+		if node := pvNode(pv); node != "" {
+			v.node = node
+			v.vgName = cs.vgName
+			return v, nil
+		}
+	}
+
+	klog.V(4).Infof("no persistent volume with node affinity found for volume %s, searching lvm inventories", id)
+	inv, lv, err := cs.findVolume(id)
+	if err != nil {
+		return nil, err
+	}
+	v.node = inv.Node
+	v.vgName = lv.VGName
+	return v, nil
+}
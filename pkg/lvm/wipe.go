@@ -0,0 +1,129 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// wipePolicyParameter in the storage class selects how the data of a volume is destroyed before removal
+	wipePolicyParameter = "wipePolicy"
+
+	wipeNone    = "none"
+	wipeDiscard = "discard"
+	wipeZero    = "zero"
+
+	// wipeTagPrefix is followed by the wipe policy, deletions do not get the parameters of the storage class
+	wipeTagPrefix = "lv.metal-stack.io/csi-lvm-wipe="
+
+	wipeBufferSize       = 4 * mib
+	wipeProgressInterval = 10 * time.Second
+)
+
+// ValidateWipePolicy returns an error for unknown wipe policies, empty is the same as none
+func ValidateWipePolicy(policy string) error {
+	switch policy {
+	case "", wipeNone, wipeDiscard, wipeZero:
+		return nil
+	}
+	return fmt.Errorf("unknown wipe policy %s, must be one of %s, %s, %s", policy, wipeNone, wipeDiscard, wipeZero)
+}
+
+// WipeTags returns the tags to store the wipe policy on the logical volume
+func WipeTags(policy string) []string {
+	if policy == "" || policy == wipeNone {
+		return nil
+	}
+	return []string{wipeTagPrefix + policy}
+}
+
+// wipePolicy returns the wipe policy the logical volume was created with
+func (lv LogicalVolume) wipePolicy() string {
+	for _, tag := range lv.Tags {
+		if strings.HasPrefix(tag, wipeTagPrefix) {
+			return strings.TrimPrefix(tag, wipeTagPrefix)
+		}
+	}
+	return wipeNone
+}
+
+// wipeLV destroys the data of the logical volume according to its wipe policy. Discard falls back to zeroing if the
+// device does not support it, zeroing is offloaded to the device with blkdiscard -z if possible.
+func wipeLV(ctx context.Context, vg string, lv *LogicalVolume) error {
+	policy := lv.wipePolicy()
+	if policy == wipeNone {
+		return nil
+	}
+	if lv.isOpen() {
+		return fmt.Errorf("logical volume %s is in use", lv.Name)
+	}
+	// zeroing the origin would fill and invalidate its copy on write snapshots
+	if err := checkNoLocalSnapshots(vg, lv.Name); err != nil {
+		return err
+	}
+	// trashed volumes are inactive
+	out, err := activateLV(ctx, vg, lv)
+	if err != nil {
+		return fmt.Errorf("unable to activate logical volume %s: %v output:%s", lv.Name, err, out)
+	}
+
+	device := lvPath(vg, lv.Name)
+	start := time.Now()
+	klog.Infof("wiping logical volume %s of size %d with policy %s", lv.Name, lv.Size, policy)
+	args := []string{device}
+	if policy == wipeZero {
+		args = []string{"-z", device}
+	}
+	klog.Infof("blkdiscard %s", args)
+	discardOut, err := runCommand(ctx, exec.CommandContext(ctx, "blkdiscard", args...))
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("wipe of logical volume %s timed out: %v", lv.Name, ctx.Err())
+		}
+		klog.Warningf("blkdiscard of logical volume %s failed, falling back to zeroing: %v output:%s", lv.Name, err, discardOut)
+		err = zeroDevice(ctx, device, lv.Size)
+		if err != nil {
+			return fmt.Errorf("unable to zero logical volume %s: %v", lv.Name, err)
+		}
+	}
+	klog.Infof("logical volume %s wiped with policy %s in %s", lv.Name, policy, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// zeroDevice overwrites the device with zeros and logs the progress
+func zeroDevice(ctx context.Context, device string, size int64) error {
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, wipeBufferSize)
+	var written int64
+	lastReport := time.Now()
+	for written < size {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %d of %d bytes: %v", written, size, ctx.Err())
+		}
+		chunk := buf
+		if size-written < int64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		n, err := f.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+		if time.Since(lastReport) > wipeProgressInterval {
+			klog.Infof("zeroing %s: %d of %d bytes (%d%%)", device, written, size, written*100/size)
+			lastReport = time.Now()
+		}
+	}
+	return f.Sync()
+}
@@ -8,7 +8,7 @@
 @test "deploy csi-lvm-controller" {
     #run helm uninstall --wait ${DOCKER_TAG} -n ${DOCKER_TAG}
     run kubectl create ns ${DOCKER_TAG}
-    run helm install ${DOCKER_TAG} --wait /files/charts/csi-driver-lvm --set pluginImage.tag=${DOCKER_TAG} --set provisionerImage.tag=${DOCKER_TAG} --set lvm.devicePattern="${DEVICEPATTERN}" --set pluginImage.pullPolicy=${PULL_POLICY} --set provisionerImage.pullPolicy=${PULL_POLICY} --set lvm.driverName="${DOCKER_TAG}.lvm.csi.metal-stack.io" --set lvm.storageClassStub="${DOCKER_TAG}-csi-lvm" --set snapshots.enabled=true --set snapshots.s3Endpoint="http://minio:9000" --set snapshots.s3AccessKey=myaccesskey --set snapshots.s3SecretKey=mysecretkey --set snapshots.encryptionPassphrase=myS3cr3tEncryptionPassphrase --set snapshots.s3BucketName=my-bucket -n ${DOCKER_TAG}
+    run helm install ${DOCKER_TAG} --wait /files/charts/csi-driver-lvm --set pluginImage.tag=${DOCKER_TAG} --set provisionerImage.tag=${DOCKER_TAG} --set lvm.devicePattern="${DEVICEPATTERN}" --set pluginImage.pullPolicy=${PULL_POLICY} --set provisionerImage.pullPolicy=${PULL_POLICY} --set lvm.driverName="${DOCKER_TAG}.lvm.csi.metal-stack.io" --set lvm.storageClassStub="${DOCKER_TAG}-csi-lvm" --set snapshots.enabled=true --set snapshots.local.enabled=true --set snapshots.s3Endpoint="http://minio:9000" --set snapshots.s3AccessKey=myaccesskey --set snapshots.s3SecretKey=mysecretkey --set snapshots.encryptionPassphrase=myS3cr3tEncryptionPassphrase --set snapshots.s3BucketName=my-bucket -n ${DOCKER_TAG}
     [ "$status" -eq 0 ]
 }
 
@@ -104,6 +104,99 @@
     [ "$output" = "20Mi" ]
 }
 
+@test "create clone of linear pvc" {
+    run kubectl apply -f /files/clone.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "persistentvolumeclaim/lvm-pvc-clone created" ]
+    [ "${lines[1]}" = "pod/volume-test-clone created" ]
+}
+
+@test "clone pvc bound" {
+    run kubectl wait -n ${DOCKER_TAG} --for=condition=ready pod/volume-test-clone --timeout=180s
+    run kubectl get -n ${DOCKER_TAG} pvc lvm-pvc-clone -o jsonpath="{.metadata.name},{.status.phase},{.status.capacity.storage}"
+    [ "$status" -eq 0 ]
+    [ "$output" = "lvm-pvc-clone,Bound,30Mi" ]
+}
+
+@test "delete clone" {
+    run kubectl delete -f /files/clone.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "persistentvolumeclaim \"lvm-pvc-clone\" deleted" ]
+    [ "${lines[1]}" = "pod \"volume-test-clone\" deleted" ]
+}
+
+@test "create volume with wipe policy" {
+    run kubectl apply -f /files/wipe.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "storageclass.storage.k8s.io/${DOCKER_TAG}-csi-lvm-linear-wipe created" ]
+    [ "${lines[1]}" = "persistentvolumeclaim/lvm-pvc-wipe created" ]
+    [ "${lines[2]}" = "pod/volume-test-wipe created" ]
+}
+
+@test "wipe pvc bound" {
+    run kubectl wait -n ${DOCKER_TAG} --for=condition=ready pod/volume-test-wipe --timeout=180s
+    run kubectl get -n ${DOCKER_TAG} pvc lvm-pvc-wipe -o jsonpath="{.metadata.name},{.status.phase}"
+    [ "$status" -eq 0 ]
+    [ "$output" = "lvm-pvc-wipe,Bound" ]
+}
+
+@test "create local snapshot of volume with wipe policy" {
+    run kubectl apply -f /files/snapshot-local-wipe.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "volumesnapshot.snapshot.storage.k8s.io/test-snapshot-wipe created" ]
+}
+
+@test "local snapshot of volume with wipe policy ready" {
+    run sleep 20
+    run kubectl get -n ${DOCKER_TAG} volumesnapshot test-snapshot-wipe -o jsonpath="{.metadata.name},{.status.readyToUse}"
+    [ "$status" -eq 0 ]
+    [ "$output" = "test-snapshot-wipe,true" ]
+}
+
+@test "delete volume with wipe policy" {
+    run kubectl delete -f /files/wipe.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[1]}" = "persistentvolumeclaim \"lvm-pvc-wipe\" deleted" ]
+    [ "${lines[2]}" = "pod \"volume-test-wipe\" deleted" ]
+}
+
+@test "local snapshot kept after deletion of its volume" {
+    run sleep 30
+    run bash -c "kubectl get -n ${DOCKER_TAG} volumesnapshot test-snapshot-wipe -o jsonpath='{.status.boundVolumeSnapshotContentName}' | xargs kubectl get volumesnapshotcontent -o jsonpath='{.status.snapshotHandle}' | xargs basename"
+    [ "$status" -eq 0 ]
+    snapshot="$output"
+    run bash -c "kubectl get cm -n ${DOCKER_TAG} -l csi-lvm.metal-stack.io/inventory=true -o yaml | grep -c ${snapshot}"
+    [ "$status" -eq 0 ]
+    run kubectl get -n ${DOCKER_TAG} volumesnapshot test-snapshot-wipe -o jsonpath="{.metadata.name},{.status.readyToUse}"
+    [ "$status" -eq 0 ]
+    [ "$output" = "test-snapshot-wipe,true" ]
+}
+
+@test "delete local snapshot of volume with wipe policy" {
+    run kubectl delete -f /files/snapshot-local-wipe.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "volumesnapshot.snapshot.storage.k8s.io \"test-snapshot-wipe\" deleted" ]
+}
+
+@test "create local snapshot" {
+    run kubectl apply -f /files/snapshot-local.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "volumesnapshot.snapshot.storage.k8s.io/test-snapshot-local created" ]
+}
+
+@test "local snapshot ready" {
+    run sleep 20
+    run kubectl get -n ${DOCKER_TAG} volumesnapshot test-snapshot-local -o jsonpath="{.metadata.name},{.status.readyToUse}"
+    [ "$status" -eq 0 ]
+    [ "$output" = "test-snapshot-local,true" ]
+}
+
+@test "delete local snapshot" {
+    run kubectl delete -f /files/snapshot-local.yaml
+    [ "$status" -eq 0 ]
+    [ "${lines[0]}" = "volumesnapshot.snapshot.storage.k8s.io \"test-snapshot-local\" deleted" ]
+}
+
 @test "create snapshot" {
     run kubectl apply -f /files/snapshot.yaml
     [ "$status" -eq 0 ]